@@ -0,0 +1,89 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2014 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/bemasher/rtlamr/parse"
+)
+
+// BreakerSink wraps a sink with a circuit breaker. After threshold
+// consecutive write errors the circuit opens and messages are dropped
+// without writing for the cool down. The first write after the cool down is
+// attempted, closing the circuit if it succeeds or opening it for another
+// cool down if not. Errors are logged rather than returned.
+type BreakerSink struct {
+	Sink
+
+	threshold int
+	coolDown  time.Duration
+
+	failures  int
+	open      bool
+	openUntil time.Time
+
+	// Total write errors and messages dropped while open, for -stats-interval.
+	Errors, Dropped uint64
+
+	now func() time.Time
+}
+
+func NewBreakerSink(sink Sink, threshold int, coolDown time.Duration) *BreakerSink {
+	return &BreakerSink{
+		Sink:      sink,
+		threshold: threshold,
+		coolDown:  coolDown,
+		now:       time.Now,
+	}
+}
+
+func (bs *BreakerSink) Write(msg parse.LogMessage) error {
+	if bs.open && bs.now().Before(bs.openUntil) {
+		bs.Dropped++
+		return nil
+	}
+
+	err := bs.Sink.Write(msg)
+	if err == nil {
+		if bs.open {
+			log.Printf("Output %s recovered, circuit closed\n", bs.Sink)
+		}
+		bs.open = false
+		bs.failures = 0
+		return nil
+	}
+
+	bs.Errors++
+	bs.failures++
+
+	// Re-open immediately if the half-open write fails.
+	if bs.open || bs.failures >= bs.threshold {
+		if !bs.open {
+			log.Printf("Error writing to output %s: %s, circuit open for %s after %d consecutive errors\n", bs.Sink, err, bs.coolDown, bs.failures)
+		} else {
+			log.Printf("Error writing to output %s: %s, circuit open for another %s\n", bs.Sink, err, bs.coolDown)
+		}
+		bs.open = true
+		bs.openUntil = bs.now().Add(bs.coolDown)
+		return nil
+	}
+
+	log.Printf("Error writing to output %s: %s\n", bs.Sink, err)
+	return nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/bemasher/rtlamr/parse"
+)
+
+type failingSink struct {
+	fail   bool
+	writes int
+}
+
+func (s *failingSink) Write(parse.LogMessage) error {
+	s.writes++
+	if s.fail {
+		return errors.New("write failed")
+	}
+	return nil
+}
+
+func (s *failingSink) Close() error   { return nil }
+func (s *failingSink) String() string { return "failing" }
+
+func TestBreakerSink(t *testing.T) {
+	sink := &failingSink{fail: true}
+	bs := NewBreakerSink(sink, 3, time.Minute)
+
+	now := time.Unix(0, 0)
+	bs.now = func() time.Time { return now }
+
+	// Opens after 3 consecutive errors, further writes are dropped.
+	for idx := 0; idx < 5; idx++ {
+		if err := bs.Write(parse.LogMessage{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if sink.writes != 3 || bs.Errors != 3 || bs.Dropped != 2 {
+		t.Fatalf("expected 3 writes, 3 errors and 2 dropped, got %d, %d and %d", sink.writes, bs.Errors, bs.Dropped)
+	}
+
+	// A failed half-open write re-opens the circuit.
+	now = now.Add(time.Minute)
+	bs.Write(parse.LogMessage{})
+	bs.Write(parse.LogMessage{})
+	if sink.writes != 4 || bs.Dropped != 3 {
+		t.Fatalf("expected 4 writes and 3 dropped, got %d and %d", sink.writes, bs.Dropped)
+	}
+
+	// A successful half-open write closes the circuit.
+	now = now.Add(time.Minute)
+	sink.fail = false
+	bs.Write(parse.LogMessage{})
+	bs.Write(parse.LogMessage{})
+	if sink.writes != 6 || bs.Dropped != 3 {
+		t.Fatalf("expected 6 writes and 3 dropped, got %d and %d", sink.writes, bs.Dropped)
+	}
+}
@@ -0,0 +1,53 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2014 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+// Number of packets to average frequency offset over when calibrating.
+const CalibratePackets = 10
+
+// Calibrator accumulates frequency offset estimates of packets from a single
+// meter and computes the equivalent correction for -freqcorrection.
+type Calibrator struct {
+	centerFreq float64
+	offsets    []float64
+}
+
+func NewCalibrator(centerFreq uint32) *Calibrator {
+	return &Calibrator{centerFreq: float64(centerFreq)}
+}
+
+// Add records the frequency offset in Hz of a packet and reports whether
+// enough packets have been received.
+func (c *Calibrator) Add(offset float64) bool {
+	c.offsets = append(c.offsets, offset)
+	return len(c.offsets) >= CalibratePackets
+}
+
+// Offset returns the average frequency offset in Hz.
+func (c *Calibrator) Offset() (avg float64) {
+	for _, offset := range c.offsets {
+		avg += offset
+	}
+	return avg / float64(len(c.offsets))
+}
+
+// PPM returns the frequency correction in parts per million which would
+// cancel the average offset. A signal received above the center frequency
+// means the dongle's oscillator is running slow.
+func (c *Calibrator) PPM() float64 {
+	return -c.Offset() / c.centerFreq * 1e6
+}
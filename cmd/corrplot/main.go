@@ -0,0 +1,103 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2014 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Command corrplot renders preamble match scores recorded by
+// decode.WithCorrelationRecorder as an ASCII heatmap, one line per block
+// with the best score of each column's sample offsets. Scores are read from
+// stdin:
+//
+//	corrplot -msgtype=scm -symbollength=72 < scores.bin
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+
+	"github.com/bemasher/rtlamr/decode"
+	"github.com/bemasher/rtlamr/idm"
+	"github.com/bemasher/rtlamr/scm"
+)
+
+// Characters for increasing scores from 0 to 1.
+const shades = " .:-=+*#%@"
+
+var packetConfigs = map[string]func(int) decode.PacketConfig{
+	"scm": scm.NewPacketConfig,
+	"idm": idm.NewPacketConfig,
+}
+
+var msgType = flag.String("msgtype", "scm", "message type scores were recorded for: scm or idm")
+var symbolLength = flag.Int("symbollength", 72, "symbol length in samples scores were recorded at")
+var columns = flag.Int("columns", 80, "width of the heatmap in characters")
+
+func main() {
+	flag.Parse()
+
+	newConfig, ok := packetConfigs[*msgType]
+	if !ok {
+		log.Fatal("Invalid message type: ", *msgType)
+	}
+	if *columns <= 0 {
+		log.Fatal("Invalid columns: ", *columns)
+	}
+
+	row := make([]float32, newConfig(*symbolLength).BlockSize)
+	offsetsPerColumn := int(math.Ceil(float64(len(row)) / float64(*columns)))
+
+	r := bufio.NewReader(os.Stdin)
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+
+	line := make([]byte, 0, *columns+1)
+	for block := 0; ; block++ {
+		err := binary.Read(r, binary.LittleEndian, row)
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			log.Fatal("Error reading scores: ", err)
+		}
+
+		line = line[:0]
+		var peak float32
+		for start := 0; start < len(row); start += offsetsPerColumn {
+			end := start + offsetsPerColumn
+			if end > len(row) {
+				end = len(row)
+			}
+
+			var best float32
+			for _, score := range row[start:end] {
+				if score > best {
+					best = score
+				}
+			}
+			if best > peak {
+				peak = best
+			}
+
+			line = append(line, shades[int(best*float32(len(shades)-1)+0.5)])
+		}
+
+		fmt.Fprintf(w, "%6d |%s| %0.2f\n", block, line, peak)
+	}
+}
@@ -0,0 +1,58 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2014 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Command example shows how to use rtlamr's packages as a library. It
+// decodes SCM messages from 8-bit interleaved IQ samples read from stdin,
+// such as the output of rtl_sdr, and prints each to stdout:
+//
+//	rtl_sdr -f 920299072 -s 2359296 - | example
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/bemasher/rtlamr/decode"
+	"github.com/bemasher/rtlamr/parse"
+	"github.com/bemasher/rtlamr/scm"
+)
+
+// Samples per symbol, the sample rate is scm.DataRate times this.
+const SymbolLength = 72
+
+func main() {
+	d := decode.NewStreamDecoder(os.Stdin, scm.NewPacketConfig(SymbolLength))
+	p := scm.NewParser()
+
+	for {
+		pkt, err := d.Next()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			log.Fatal("Error reading samples: ", err)
+		}
+
+		msg, err := p.Parse(parse.NewDataFromBytes(pkt))
+		if err != nil {
+			continue
+		}
+
+		fmt.Println(msg.(scm.SCM))
+	}
+}
@@ -0,0 +1,54 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2014 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Command protodec decodes messages written by rtlamr's -format=protobuf
+// from stdin and writes each to stdout as a line of json:
+//
+//	protodec < meters.pb
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+
+	"github.com/bemasher/rtlamr/protobuf"
+)
+
+func main() {
+	dec := protobuf.NewDecoder(os.Stdin)
+
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+	enc := json.NewEncoder(w)
+
+	for {
+		r, err := dec.Decode()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			w.Flush()
+			log.Fatal("Error decoding message: ", err)
+		}
+
+		if err := enc.Encode(r); err != nil {
+			log.Fatal("Error writing message: ", err)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2014 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Command rtlamux shares one rtl_tcp server between multiple rtlamr
+// instances, for example to receive SCM and IDM messages simultaneously.
+// Clients connect to rtlamux as they would to rtl_tcp.
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+
+	"github.com/bemasher/rtlamr/mux"
+)
+
+var server = flag.String("server", "127.0.0.1:1234", "address or hostname of rtl_tcp instance")
+var listen = flag.String("listen", "127.0.0.1:1235", "address to accept clients on")
+
+func main() {
+	flag.Parse()
+
+	upstream, err := net.Dial("tcp", *server)
+	if err != nil {
+		log.Fatal("Error connecting to rtl_tcp: ", err)
+	}
+	defer upstream.Close()
+
+	m, err := mux.New(upstream)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", *listen)
+	if err != nil {
+		log.Fatal("Error listening for clients: ", err)
+	}
+	defer l.Close()
+
+	go func() {
+		log.Fatal("Error accepting clients: ", m.Serve(l))
+	}()
+
+	log.Println("Listening for clients on", l.Addr())
+	log.Fatal("Error reading samples: ", m.Run())
+}
@@ -0,0 +1,160 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2014 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package decode
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+)
+
+// CorrelationPeak is a local maximum of the correlation between a signal and
+// a preamble template.
+type CorrelationPeak struct {
+	Offset int     // Sample offset of the start of the preamble.
+	Score  float64 // Normalized correlation in the range [-1, 1].
+}
+
+// Correlator finds a preamble in a real valued signal such as the magnitude
+// of a block of samples, by normalized cross-correlation. It's independent of
+// the Decoder, which searches the quantized signal for exact bit matches, and
+// is intended for experimenting with alternative preamble detection.
+type Correlator struct {
+	// Minimum score of reported peaks.
+	Threshold float64
+}
+
+// Correlate slides the preamble template over the signal and returns each
+// offset where the normalized correlation is at least the threshold and no
+// less than at neighboring offsets. The signal is mean removed over each
+// window so the template needn't account for DC offset.
+//
+// Decode doesn't use Correlate, it searches for the preamble by its own
+// bit comparison. Peaks found here may not match the packets Decode finds
+// in the same samples.
+func (c Correlator) Correlate(signal []float32, preamble []float32) (peaks []CorrelationPeak) {
+	n := len(preamble)
+	if n == 0 || len(signal) < n {
+		return nil
+	}
+
+	var templateSum, templateEnergy float64
+	for _, t := range preamble {
+		templateSum += float64(t)
+		templateEnergy += float64(t) * float64(t)
+	}
+	templateMean := templateSum / float64(n)
+	templateNorm := math.Sqrt(templateEnergy - float64(n)*templateMean*templateMean)
+
+	// Cumulative sums of the signal and its square give the mean and energy
+	// of each window in constant time.
+	sum := make([]float64, len(signal)+1)
+	sumSq := make([]float64, len(signal)+1)
+	for idx, v := range signal {
+		sum[idx+1] = sum[idx] + float64(v)
+		sumSq[idx+1] = sumSq[idx] + float64(v)*float64(v)
+	}
+
+	scores := make([]float64, len(signal)-n+1)
+	for offset := range scores {
+		var dot float64
+		for idx, t := range preamble {
+			dot += float64(t) * float64(signal[offset+idx])
+		}
+
+		mean := (sum[offset+n] - sum[offset]) / float64(n)
+		energy := sumSq[offset+n] - sumSq[offset] - float64(n)*mean*mean
+		if energy <= 0 || templateNorm == 0 {
+			continue
+		}
+
+		scores[offset] = (dot - mean*templateSum) / (templateNorm * math.Sqrt(energy))
+	}
+
+	for offset, score := range scores {
+		if score < c.Threshold {
+			continue
+		}
+		if offset > 0 && scores[offset-1] > score {
+			continue
+		}
+		if offset < len(scores)-1 && scores[offset+1] > score {
+			continue
+		}
+		peaks = append(peaks, CorrelationPeak{offset, score})
+	}
+
+	return peaks
+}
+
+// PreambleTemplate returns the Manchester coded preamble at the sample rate,
+// each symbol as SymbolLength samples of 1 followed by SymbolLength samples
+// of -1, or the reverse for a 0 symbol.
+func (cfg PacketConfig) PreambleTemplate() []float32 {
+	template := make([]float32, 0, cfg.PreambleLength)
+	for _, bit := range cfg.Preamble {
+		first := float32(-1)
+		if bit == '1' {
+			first = 1
+		}
+		for idx := 0; idx < cfg.SymbolLength; idx++ {
+			template = append(template, first)
+		}
+		for idx := 0; idx < cfg.SymbolLength; idx++ {
+			template = append(template, -first)
+		}
+	}
+	return template
+}
+
+// Writes the preamble match score at each sample offset of a block, the
+// fraction of preamble symbols matching the quantized signal. The decoder
+// accepts offsets scoring at least its threshold.
+type correlationRecorder struct {
+	w   io.Writer
+	row []byte
+	err error
+}
+
+func (cr *correlationRecorder) record(quantized, preamble []byte, symbolLength2 int) {
+	if cr.err != nil {
+		return
+	}
+
+	for offset := 0; offset < len(cr.row)>>2; offset++ {
+		var matches int
+		for bitIdx, bit := range preamble {
+			if bit == quantized[offset+bitIdx*symbolLength2] {
+				matches++
+			}
+		}
+
+		score := float32(matches) / float32(len(preamble))
+		binary.LittleEndian.PutUint32(cr.row[offset<<2:], math.Float32bits(score))
+	}
+
+	_, cr.err = cr.w.Write(cr.row)
+}
+
+// CorrelationErr returns the error which stopped WithCorrelationRecorder
+// from writing, if any.
+func (d Decoder) CorrelationErr() error {
+	if d.corr == nil {
+		return nil
+	}
+	return d.corr.err
+}
@@ -0,0 +1,41 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2014 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package decode
+
+// Decimate reduces 8-bit interleaved IQ samples by the given factor, writing
+// the average of each factor consecutive samples of input to output. The
+// average is a single stage CIC filter, attenuating signals aliased from
+// outside the reduced sample rate. Panics unless input holds exactly factor
+// times as many samples as output.
+func Decimate(input, output []byte, factor int) {
+	if len(input) != len(output)*factor {
+		panic("decode.Decimate: input length must be output length times factor")
+	}
+
+	for idx := 0; idx < len(output); idx += 2 {
+		var i, q int
+		block := input[idx*factor : (idx+2)*factor]
+		for sample := 0; sample < len(block); sample += 2 {
+			i += int(block[sample])
+			q += int(block[sample+1])
+		}
+
+		// Round to the nearest integer.
+		output[idx] = byte((i + factor/2) / factor)
+		output[idx+1] = byte((q + factor/2) / factor)
+	}
+}
@@ -17,11 +17,38 @@
 package decode
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"log"
 	"math"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
+// Sample rates supported by rtl-sdr dongles are within these exclusive
+// ranges, in Hz.
+const (
+	MinLowSampleRate  = 225000
+	MaxLowSampleRate  = 300000
+	MinHighSampleRate = 900000
+	MaxHighSampleRate = 3200000
+)
+
+// CheckSymbolLength returns an error if symbolLength samples per symbol at the
+// given data rate requires a sample rate the dongle can't provide.
+func CheckSymbolLength(symbolLength, dataRate int) error {
+	sampleRate := symbolLength * dataRate
+	if symbolLength <= 0 ||
+		(sampleRate <= MinLowSampleRate || sampleRate >= MaxLowSampleRate) &&
+			(sampleRate <= MinHighSampleRate || sampleRate >= MaxHighSampleRate) {
+		return fmt.Errorf("%d samples per symbol requires an unsupported sample rate of %d Hz", symbolLength, sampleRate)
+	}
+	return nil
+}
+
 // PacketConfig specifies packet-specific radio configuration.
 type PacketConfig struct {
 	DataRate                    int
@@ -35,16 +62,56 @@ type PacketConfig struct {
 	Preamble                       string
 }
 
+// Overrides the computed block size. Size is given in bytes of interleaved
+// IQ samples and is rounded down to a whole number of samples, it need not
+// be a power of 2. The block must be at least as long as the preamble and at
+// most as long as the packet.
+func (cfg *PacketConfig) SetBlockSize(size int) error {
+	blockSize := size >> 1
+	if blockSize < cfg.PreambleLength || blockSize > cfg.PacketLength {
+		return fmt.Errorf("block size must be between %d and %d bytes", cfg.PreambleLength<<1, cfg.PacketLength<<1)
+	}
+
+	cfg.BlockSize = blockSize
+	cfg.BlockSize2 = blockSize << 1
+	cfg.BufferLength = cfg.PacketLength + cfg.BlockSize
+
+	return nil
+}
+
+// String returns a multi-line summary of the configuration, one field per
+// line.
+func (cfg PacketConfig) String() string {
+	lines := []string{
+		fmt.Sprintf("BlockSize: %d", cfg.BlockSize),
+		fmt.Sprintf("BufferLength: %d", cfg.BufferLength),
+		fmt.Sprintf("SampleRate: %d", cfg.SampleRate),
+		fmt.Sprintf("DataRate: %d", cfg.DataRate),
+		fmt.Sprintf("SymbolLength: %d", cfg.SymbolLength),
+		fmt.Sprintf("PreambleSymbols: %d", cfg.PreambleSymbols),
+		fmt.Sprintf("PreambleLength: %d", cfg.PreambleLength),
+		fmt.Sprintf("PacketSymbols: %d", cfg.PacketSymbols),
+		fmt.Sprintf("PacketLength: %d", cfg.PacketLength),
+		fmt.Sprintf("Preamble: %s (0x%X)", cfg.Preamble, cfg.PreambleValue()),
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Returns the preamble bits as an integer.
+func (cfg PacketConfig) PreambleValue() (v uint64) {
+	for _, bit := range cfg.Preamble {
+		v <<= 1
+		if bit == '1' {
+			v |= 1
+		}
+	}
+	return
+}
+
 func (cfg PacketConfig) Log() {
-	log.Println("BlockSize:", cfg.BlockSize)
-	log.Println("SampleRate:", cfg.SampleRate)
-	log.Println("DataRate:", cfg.DataRate)
-	log.Println("SymbolLength:", cfg.SymbolLength)
-	log.Println("PreambleSymbols:", cfg.PreambleSymbols)
-	log.Println("PreambleLength:", cfg.PreambleLength)
-	log.Println("PacketSymbols:", cfg.PacketSymbols)
-	log.Println("PacketLength:", cfg.PacketLength)
-	log.Println("Preamble:", cfg.Preamble)
+	for _, line := range strings.Split(cfg.String(), "\n") {
+		log.Println(line)
+	}
 }
 
 // Decoder contains buffers and radio configuration.
@@ -61,12 +128,136 @@ type Decoder struct {
 	preamble []byte
 	slices   [][]byte
 
+	fastMag   bool
+	threshold float64
+	maxErrors int
+	agc       *AGC
+	sliding   bool
+	dcBlock   bool
+	corr      *correlationRecorder
+
+	stats *Stats
+
 	pkt []byte
 }
 
-// Create a new decoder with the given packet configuration.
-func NewDecoder(cfg PacketConfig, fastMag bool) (d Decoder) {
+// Stats describes decoder performance, counters are cumulative since the
+// decoder was created.
+type Stats struct {
+	BlocksProcessed uint64
+	PreambleHits    uint64
+	PacketsDecoded  uint64
+	CRCFailures     uint64
+	LowSNR          uint64
+	BytesConsumed   uint64
+	TotalDecodeTime time.Duration
+}
+
+// Returns a snapshot of the decoder's counters.
+func (d Decoder) Stats() (s Stats) {
+	s.BlocksProcessed = atomic.LoadUint64(&d.stats.BlocksProcessed)
+	s.PreambleHits = atomic.LoadUint64(&d.stats.PreambleHits)
+	s.PacketsDecoded = atomic.LoadUint64(&d.stats.PacketsDecoded)
+	s.CRCFailures = atomic.LoadUint64(&d.stats.CRCFailures)
+	s.LowSNR = atomic.LoadUint64(&d.stats.LowSNR)
+	s.BytesConsumed = atomic.LoadUint64(&d.stats.BytesConsumed)
+	s.TotalDecodeTime = time.Duration(atomic.LoadInt64((*int64)(&d.stats.TotalDecodeTime)))
+	return
+}
+
+// The decoder doesn't check packets, parsers should report failed checksums
+// so they're included in the decoder's stats.
+func (d Decoder) AddCRCFailure() {
+	atomic.AddUint64(&d.stats.CRCFailures, 1)
+}
+
+// Packets discarded for low signal to noise ratio are reported by the caller
+// so they're included in the decoder's stats.
+func (d Decoder) AddLowSNR() {
+	atomic.AddUint64(&d.stats.LowSNR, 1)
+}
+
+// An Option configures optional behavior of a Decoder.
+type Option func(*Decoder)
+
+// Use faster alpha max + beta min magnitude approximation.
+func WithFastMag() Option {
+	return func(d *Decoder) {
+		d.fastMag = true
+	}
+}
+
+// Accept preamble matches where at least the given fraction of preamble
+// symbols are correct. Defaults to 1.0, only exact matches. Panics if the
+// threshold isn't in the range [0, 1].
+func WithThreshold(threshold float64) Option {
+	if !(threshold >= 0 && threshold <= 1) {
+		panic(fmt.Sprintf("decode.WithThreshold: threshold %v not in [0, 1]", threshold))
+	}
+	return func(d *Decoder) {
+		d.threshold = threshold
+	}
+}
+
+// Normalize the magnitude signal by an envelope which tracks rising signal
+// with the attack rate and falling signal with the decay rate. Panics if
+// either rate isn't in the range (0, 1].
+func WithAGC(attack, decay float64) Option {
+	if !(attack > 0 && attack <= 1) || !(decay > 0 && decay <= 1) {
+		panic(fmt.Sprintf("decode.WithAGC: rates %v and %v not in (0, 1]", attack, decay))
+	}
+	return func(d *Decoder) {
+		d.agc = &AGC{Attack: attack, Decay: decay}
+	}
+}
+
+// Search for the preamble by sliding it one sample at a time along the
+// quantized signal instead of searching packed per-offset slices. Slower,
+// but independent of how the block divides into symbols.
+func WithSlidingWindow() Option {
+	return func(d *Decoder) {
+		d.sliding = true
+	}
+}
+
+// Subtract the mean of each block's I and Q components before computing
+// magnitude, removing the DC offset some dongles have at the center frequency.
+func WithDCBlock() Option {
+	return func(d *Decoder) {
+		d.dcBlock = true
+	}
+}
+
+// After each block write a row of preamble match scores to w, one
+// little-endian float32 per sample offset of the block. Write errors stop
+// recording and are reported by CorrelationErr.
+func WithCorrelationRecorder(w io.Writer) Option {
+	return func(d *Decoder) {
+		d.corr = &correlationRecorder{w: w}
+	}
+}
+
+// Create a new decoder with the given packet configuration. This is the old
+// two-argument NewDecoder, renamed because NewDecoder now takes options and
+// Go has no overloading. Callers of NewDecoder(cfg, fastMag) must be updated.
+//
+// Deprecated: Use NewDecoder with WithFastMag.
+func NewDecoderFastMag(cfg PacketConfig, fastMag bool) Decoder {
+	if fastMag {
+		return NewDecoder(cfg, WithFastMag())
+	}
+	return NewDecoder(cfg)
+}
+
+// Create a new decoder with the given packet configuration and options.
+func NewDecoder(cfg PacketConfig, opts ...Option) (d Decoder) {
 	d.Cfg = cfg
+	d.threshold = 1.0
+	d.stats = new(Stats)
+
+	for _, opt := range opts {
+		opt(&d)
+	}
 
 	// Allocate necessary buffers.
 	d.IQ = make([]byte, d.Cfg.BufferLength<<1)
@@ -76,12 +267,20 @@ func NewDecoder(cfg PacketConfig, fastMag bool) (d Decoder) {
 	d.csum = make([]float64, d.Cfg.BlockSize+d.Cfg.SymbolLength2+1)
 
 	// Calculate magnitude lookup table specified by -fastmag flag.
-	if fastMag {
+	if d.fastMag {
 		d.lut = NewAlphaMaxBetaMinLUT()
 	} else {
 		d.lut = NewSqrtMagLUT()
 	}
 
+	if d.dcBlock {
+		d.lut = DCBlockMag{FastMag: d.fastMag}
+	}
+
+	if d.corr != nil {
+		d.corr.row = make([]byte, d.Cfg.BlockSize<<2)
+	}
+
 	// Pre-calculate a byte-slice version of the preamble for searching.
 	d.preamble = make([]byte, len(d.Cfg.Preamble))
 	for idx := range d.Cfg.Preamble {
@@ -90,6 +289,9 @@ func NewDecoder(cfg PacketConfig, fastMag bool) (d Decoder) {
 		}
 	}
 
+	// Number of preamble symbols allowed to mismatch.
+	d.maxErrors = int((1 - d.threshold) * float64(len(d.preamble)))
+
 	// Slice quantized sample buffer to make searching for the preamble more
 	// memory local. Pre-allocate a flat buffer so memory is contiguous and
 	// assign slices to the buffer.
@@ -110,7 +312,44 @@ func NewDecoder(cfg PacketConfig, fastMag bool) (d Decoder) {
 }
 
 // Decode accepts a sample block and performs various DSP techniques to extract a packet.
+// Every packet whose preamble matches is returned, checksums aren't checked
+// until packets are parsed.
 func (d Decoder) Decode(input []byte) (pkts [][]byte) {
+	for _, result := range d.DecodeWithOffsets(input) {
+		pkts = append(pkts, result.Bytes)
+	}
+	return
+}
+
+// PacketResult is a packet found by DecodeWithOffsets.
+type PacketResult struct {
+	Bytes []byte
+
+	// Sample offset of the start of the preamble relative to the start of
+	// the block given to DecodeWithOffsets. Packets are only complete well
+	// after their preamble so the offset is usually negative, the preamble
+	// having been received in a previous block. The packet's samples start
+	// at Decoder.IQ[(BlockOffset+PacketLength)<<1].
+	BlockOffset int
+
+	// Fraction of preamble symbols matching, 1 for an exact match.
+	Score float64
+}
+
+// DecodeWithOffsets is like Decode but also returns where each packet was
+// found. Of the neighboring offsets each packet is found at, the one with
+// the strongest filtered signal is reported. Offsets are accurate to within
+// a symbol, the best aligned offset of a packet at the end of the block's
+// search range may not be searched until the next block.
+func (d Decoder) DecodeWithOffsets(input []byte) (results []PacketResult) {
+	start := time.Now()
+	defer func() {
+		atomic.AddUint64(&d.stats.BlocksProcessed, 1)
+		atomic.AddUint64(&d.stats.BytesConsumed, uint64(len(input)))
+		atomic.AddUint64(&d.stats.PacketsDecoded, uint64(len(results)))
+		atomic.AddInt64((*int64)(&d.stats.TotalDecodeTime), int64(time.Since(start)))
+	}()
+
 	// Shift buffers to append new block.
 	copy(d.IQ, d.IQ[d.Cfg.BlockSize<<1:])
 	copy(d.Signal, d.Signal[d.Cfg.BlockSize:])
@@ -123,6 +362,10 @@ func (d Decoder) Decode(input []byte) (pkts [][]byte) {
 	// Compute the magnitude of the new block.
 	d.lut.Execute(iqBlock, signalBlock)
 
+	if d.agc != nil {
+		d.agc.Execute(signalBlock)
+	}
+
 	signalBlock = d.Signal[d.Cfg.PacketLength-d.Cfg.SymbolLength2:]
 
 	// Perform matched filter on new block.
@@ -133,14 +376,22 @@ func (d Decoder) Decode(input []byte) (pkts [][]byte) {
 	Quantize(signalBlock, d.Quantized[d.Cfg.PacketLength-d.Cfg.SymbolLength2:])
 
 	// Pack the quantized signal into slices for searching.
-	d.Pack(d.Quantized[:d.Cfg.BlockSize2], d.slices)
+	if !d.sliding {
+		d.Pack(d.Quantized[:d.Cfg.BlockSize2], d.slices)
+	}
 
 	// Get a list of indexes the preamble exists at.
-	indexes := d.Search(d.slices, d.preamble)
+	indexes := d.search()
+
+	if d.corr != nil {
+		d.corr.record(d.Quantized, d.preamble, d.Cfg.SymbolLength2)
+	}
 
 	// We will likely find multiple instances of the message so only keep
-	// track of unique instances.
-	seen := make(map[string]bool)
+	// track of unique instances, by index in the results and the strength of
+	// the instance kept.
+	seen := make(map[string]int)
+	var strengths []float64
 
 	// For each of the indexes the preamble exists at.
 	for _, qIdx := range indexes {
@@ -149,24 +400,209 @@ func (d Decoder) Decode(input []byte) (pkts [][]byte) {
 		if qIdx > d.Cfg.BlockSize {
 			continue
 		}
+		atomic.AddUint64(&d.stats.PreambleHits, 1)
 
 		// Packet is 1 bit per byte, pack to 8-bits per byte.
+		var strength float64
 		for pIdx := 0; pIdx < d.Cfg.PacketSymbols; pIdx++ {
 			d.pkt[pIdx>>3] <<= 1
 			d.pkt[pIdx>>3] |= d.Quantized[qIdx+(pIdx*d.Cfg.SymbolLength2)]
+			strength += math.Abs(d.Signal[qIdx+(pIdx*d.Cfg.SymbolLength2)])
+		}
+
+		var matches int
+		for bitIdx, bit := range d.preamble {
+			if d.Quantized[qIdx+bitIdx*d.Cfg.SymbolLength2] == bit {
+				matches++
+			}
+		}
+
+		result := PacketResult{
+			BlockOffset: qIdx - d.Cfg.PacketLength,
+			Score:       float64(matches) / float64(len(d.preamble)),
 		}
 
-		// Store the packet in the seen map and append to the packet list.
+		// Store the packet in the seen map and append to the result list, or
+		// replace the instance kept if this one is stronger.
 		pktStr := fmt.Sprintf("%02X", d.pkt)
-		if !seen[pktStr] {
-			seen[pktStr] = true
-			pkts = append(pkts, make([]byte, len(d.pkt)))
-			copy(pkts[len(pkts)-1], d.pkt)
+		if idx, ok := seen[pktStr]; ok {
+			if strength > strengths[idx] {
+				result.Bytes = results[idx].Bytes
+				results[idx], strengths[idx] = result, strength
+			}
+			continue
+		}
+
+		seen[pktStr] = len(results)
+		result.Bytes = make([]byte, len(d.pkt))
+		copy(result.Bytes, d.pkt)
+		results = append(results, result)
+		strengths = append(strengths, strength)
+	}
+	return
+}
+
+// Returns the index in the current buffer of a packet returned by the most
+// recent call to Decode. The preamble matches at several neighboring offsets
+// so the one with the strongest filtered signal is used.
+func (d Decoder) packetIndex(pkt []byte) (idx int, found bool) {
+	var best float64
+	for _, qIdx := range d.search() {
+		if qIdx > d.Cfg.BlockSize {
+			continue
+		}
+
+		var strength float64
+		for pIdx := 0; pIdx < d.Cfg.PacketSymbols; pIdx++ {
+			d.pkt[pIdx>>3] <<= 1
+			d.pkt[pIdx>>3] |= d.Quantized[qIdx+(pIdx*d.Cfg.SymbolLength2)]
+			strength += math.Abs(d.Signal[qIdx+(pIdx*d.Cfg.SymbolLength2)])
+		}
+
+		if bytes.Equal(d.pkt, pkt) && (!found || strength > best) {
+			idx, found, best = qIdx, true, strength
 		}
 	}
+
 	return
 }
 
+// FreqOffset estimates the frequency offset in Hz of a packet returned by the
+// most recent call to Decode, relative to the center frequency. The estimate
+// is the average phase rotation between consecutive samples spanning the
+// packet, weighted by signal power. Returns false if the packet isn't found
+// in the current buffer.
+func (d Decoder) FreqOffset(pkt []byte) (float64, bool) {
+	qIdx, ok := d.packetIndex(pkt)
+	if !ok {
+		return 0, false
+	}
+
+	var re, im float64
+	iq := d.IQ[qIdx<<1 : (qIdx+d.Cfg.PacketLength)<<1]
+	for idx := 2; idx < len(iq); idx += 2 {
+		i0, q0 := float64(iq[idx-2])-127.5, float64(iq[idx-1])-127.5
+		i1, q1 := float64(iq[idx])-127.5, float64(iq[idx+1])-127.5
+
+		// Accumulate the product of each sample and the conjugate of its
+		// predecessor.
+		re += i1*i0 + q1*q0
+		im += q1*i0 - i1*q0
+	}
+
+	return math.Atan2(im, re) * float64(d.Cfg.SampleRate) / (2 * math.Pi), true
+}
+
+// SNR estimates the signal to noise ratio in dB of a packet returned by the
+// most recent call to Decode. Each Manchester coded bit has one half on and
+// the other off, so the power of the off halves estimates noise and the
+// excess power of the on halves estimates signal. Packets without excess
+// power, such as those decoded from noise, have an SNR of -Inf. Returns
+// false if the packet isn't found in the current buffer.
+func (d Decoder) SNR(pkt []byte) (float64, bool) {
+	qIdx, ok := d.packetIndex(pkt)
+	if !ok {
+		return 0, false
+	}
+
+	power := func(lower, upper int) (p float64) {
+		for _, v := range d.IQ[lower<<1 : upper<<1] {
+			p += (float64(v) - 127.5) * (float64(v) - 127.5)
+		}
+		return p
+	}
+
+	var on, off float64
+	for pIdx := 0; pIdx < d.Cfg.PacketSymbols; pIdx++ {
+		start := qIdx + pIdx*d.Cfg.SymbolLength2
+		first := power(start, start+d.Cfg.SymbolLength)
+		second := power(start+d.Cfg.SymbolLength, start+d.Cfg.SymbolLength2)
+
+		if d.Quantized[start] == 1 {
+			on, off = on+first, off+second
+		} else {
+			on, off = on+second, off+first
+		}
+	}
+
+	if on <= off {
+		return math.Inf(-1), true
+	}
+
+	return 10 * math.Log10((on-off)/off), true
+}
+
+// DecodeStream reads sample blocks from r until it is exhausted or ctx is
+// cancelled, sending each packet found to out. Returns io.EOF when r is
+// exhausted, the context's error if cancelled or the underlying read error.
+func (d Decoder) DecodeStream(ctx context.Context, r io.Reader, out chan<- []byte) error {
+	block := make([]byte, d.Cfg.BlockSize2)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		// A partial block can't be decoded, treat it as the end of the stream.
+		_, err := io.ReadFull(r, block)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return io.EOF
+		}
+		if err != nil {
+			return fmt.Errorf("error reading samples: %s", err)
+		}
+
+		for _, pkt := range d.Decode(block) {
+			select {
+			case out <- pkt:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+}
+
+// StreamDecoder decodes packets from a stream of samples one at a time.
+type StreamDecoder struct {
+	Decoder
+
+	r     io.Reader
+	block []byte
+	pkts  [][]byte
+}
+
+// Create a new stream decoder reading samples from r.
+func NewStreamDecoder(r io.Reader, cfg PacketConfig, opts ...Option) *StreamDecoder {
+	d := NewDecoder(cfg, opts...)
+	return &StreamDecoder{
+		Decoder: d,
+		r:       r,
+		block:   make([]byte, d.Cfg.BlockSize2),
+	}
+}
+
+// Next returns the next packet decoded from the stream. Returns io.EOF once
+// the stream is exhausted.
+func (sd *StreamDecoder) Next() (pkt []byte, err error) {
+	for len(sd.pkts) == 0 {
+		// A partial block can't be decoded, treat it as the end of the stream.
+		_, err = io.ReadFull(sd.r, sd.block)
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		sd.pkts = sd.Decode(sd.block)
+	}
+
+	pkt, sd.pkts = sd.pkts[0], sd.pkts[1:]
+	return pkt, nil
+}
+
 // A MagnitudeLUT knows how to perform complex magnitude on a slice of IQ samples.
 type MagnitudeLUT interface {
 	Execute([]byte, []float64)
@@ -224,6 +660,65 @@ func (lut AlphaMaxBetaMinLUT) Execute(input []byte, output []float64) {
 	}
 }
 
+// Magnitude with the DC offset removed, the mean of I and Q over each block
+// is subtracted from every sample before computing magnitude.
+type DCBlockMag struct {
+	FastMag bool
+}
+
+// Calculates complex magnitude on given IQ stream writing result to output.
+func (dc DCBlockMag) Execute(input []byte, output []float64) {
+	const (
+		α = 0.948059448969
+		ß = 0.392699081699
+	)
+
+	var iMean, qMean float64
+	for idx := range output {
+		iMean += float64(input[idx<<1])
+		qMean += float64(input[idx<<1+1])
+	}
+	iMean /= float64(len(output))
+	qMean /= float64(len(output))
+
+	for idx := range output {
+		i := float64(input[idx<<1]) - iMean
+		q := float64(input[idx<<1+1]) - qMean
+		if !dc.FastMag {
+			output[idx] = math.Sqrt(i*i + q*q)
+			continue
+		}
+
+		i, q = math.Abs(i), math.Abs(q)
+		if i > q {
+			output[idx] = α*i + ß*q
+		} else {
+			output[idx] = α*q + ß*i
+		}
+	}
+}
+
+// Automatic gain control, tracks the envelope of the magnitude signal.
+type AGC struct {
+	Attack, Decay float64
+	level         float64
+}
+
+// Normalizes the given signal in place by the tracked envelope.
+func (agc *AGC) Execute(signal []float64) {
+	for idx, v := range signal {
+		if v > agc.level {
+			agc.level += agc.Attack * (v - agc.level)
+		} else {
+			agc.level += agc.Decay * (v - agc.level)
+		}
+
+		if agc.level > 0 {
+			signal[idx] = v / agc.level
+		}
+	}
+}
+
 // Matched filter for Manchester coded signals. Output signal's sign at each
 // sample determines the bit-value since Manchester symbols have odd symmetry.
 func (d Decoder) Filter(input []float64) {
@@ -273,14 +768,14 @@ func (d Decoder) Pack(input []byte, slices [][]byte) {
 func (d Decoder) Search(slices [][]byte, preamble []byte) (indexes []int) {
 	for symbolOffset, slice := range slices {
 		for symbolIdx := range slice[:len(slice)-len(preamble)] {
-			var result uint8
+			var errors int
 			for bitIdx, bit := range preamble {
-				result |= bit ^ slice[symbolIdx+bitIdx]
-				if result != 0 {
+				errors += int(bit ^ slice[symbolIdx+bitIdx])
+				if errors > d.maxErrors {
 					break
 				}
 			}
-			if result == 0 {
+			if errors <= d.maxErrors {
 				indexes = append(indexes, symbolIdx*d.Cfg.SymbolLength2+symbolOffset)
 			}
 		}
@@ -289,6 +784,34 @@ func (d Decoder) Search(slices [][]byte, preamble []byte) (indexes []int) {
 	return
 }
 
+// Searches the current block for the preamble by the configured method.
+func (d Decoder) search() []int {
+	if d.sliding {
+		return d.SearchSliding(d.Quantized, d.preamble)
+	}
+	return d.Search(d.slices, d.preamble)
+}
+
+// Look for the preamble at every sample offset of the quantized signal up to
+// and including the block size. Returns the indexes the preamble is found
+// at in ascending order.
+func (d Decoder) SearchSliding(quantized []byte, preamble []byte) (indexes []int) {
+	for qIdx := 0; qIdx <= d.Cfg.BlockSize; qIdx++ {
+		var errors int
+		for bitIdx, bit := range preamble {
+			errors += int(bit ^ quantized[qIdx+bitIdx*d.Cfg.SymbolLength2])
+			if errors > d.maxErrors {
+				break
+			}
+		}
+		if errors <= d.maxErrors {
+			indexes = append(indexes, qIdx)
+		}
+	}
+
+	return
+}
+
 func NextPowerOf2(v int) int {
 	return 1 << uint(math.Ceil(math.Log2(float64(v))))
 }
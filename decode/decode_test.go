@@ -0,0 +1,738 @@
+package decode_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bemasher/rtlamr/decode"
+	"github.com/bemasher/rtlamr/idm"
+	"github.com/bemasher/rtlamr/internal/testutil"
+	"github.com/bemasher/rtlamr/parse"
+	"github.com/bemasher/rtlamr/scm"
+)
+
+const SymbolLength = 73
+
+// Decodes the given samples block by block, returning each packet found.
+func DecodeAll(d decode.Decoder, iq []byte) (pkts [][]byte) {
+	blockSize := d.Cfg.BlockSize2
+	for idx := 0; idx+blockSize <= len(iq); idx += blockSize {
+		pkts = append(pkts, d.Decode(iq[idx:idx+blockSize])...)
+	}
+	return
+}
+
+// Roughly 10 MB of synthesized samples with a packet every ~50ms.
+func NewSampleFile(cfg decode.PacketConfig) (iq []byte) {
+	rng := rand.New(rand.NewSource(1))
+
+	gap := cfg.SampleRate / 40
+	for id := uint32(1); len(iq) < 10<<20; id++ {
+		iq = append(iq, testutil.Synthesize(cfg, testutil.NewSCMPacket(id, id*10), gap, rng)...)
+	}
+
+	return
+}
+
+func TestPacketConfigString(t *testing.T) {
+	cfg := scm.NewPacketConfig(SymbolLength)
+
+	expected := strings.Join([]string{
+		"BlockSize: 4096",
+		"BufferLength: 18112",
+		"SampleRate: 2392064",
+		"DataRate: 32768",
+		"SymbolLength: 73",
+		"PreambleSymbols: 21",
+		"PreambleLength: 3066",
+		"PacketSymbols: 96",
+		"PacketLength: 14016",
+		"Preamble: 111110010101001100000 (0x1F2A60)",
+	}, "\n")
+
+	if s := cfg.String(); s != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, s)
+	}
+}
+
+// Decodes a single packet starting at every sample offset within a block so
+// the packet is split across block boundaries at every possible point.
+func testBlockBoundary(t *testing.T, cfg decode.PacketConfig) {
+	p := scm.NewParser()
+
+	const id = 12345678
+	iq := testutil.Synthesize(cfg, testutil.NewSCMPacket(id, 1000), cfg.BlockSize2, rand.New(rand.NewSource(1)))
+
+	for offset := 0; offset < cfg.BlockSize; offset++ {
+		d := decode.NewDecoder(cfg)
+
+		found := false
+		for _, pkt := range DecodeAll(d, iq[offset<<1:]) {
+			msg, err := p.Parse(parse.NewDataFromBytes(pkt))
+			if err == nil && msg.MeterID() == id {
+				found = true
+			}
+		}
+
+		if !found {
+			t.Fatalf("packet not found at sample offset %d", offset)
+		}
+	}
+}
+
+func TestDecodeBlockBoundary(t *testing.T) {
+	testBlockBoundary(t, scm.NewPacketConfig(32))
+}
+
+func TestDecodeNonPowerOf2BlockSize(t *testing.T) {
+	cfg := scm.NewPacketConfig(32)
+	if err := cfg.SetBlockSize(3000 << 1); err != nil {
+		t.Fatal(err)
+	}
+	testBlockBoundary(t, cfg)
+}
+
+// Synthesized packets are rotated by a sixteenth of the sample rate.
+func TestFreqOffset(t *testing.T) {
+	cfg := scm.NewPacketConfig(SymbolLength)
+	d := decode.NewDecoder(cfg)
+
+	iq := testutil.Synthesize(cfg, testutil.NewSCMPacket(12345678, 1000), cfg.BlockSize2, rand.New(rand.NewSource(1)))
+
+	expected := float64(cfg.SampleRate) / 16
+
+	found := false
+	for idx := 0; idx+cfg.BlockSize2 <= len(iq); idx += cfg.BlockSize2 {
+		for _, pkt := range d.Decode(iq[idx : idx+cfg.BlockSize2]) {
+			offset, ok := d.FreqOffset(pkt)
+			if !ok {
+				t.Fatalf("packet %02X not found", pkt)
+			}
+			if math.Abs(offset-expected) > expected*0.01 {
+				t.Errorf("expected %0.0f Hz, got %0.0f Hz", expected, offset)
+			}
+			found = true
+		}
+	}
+
+	if !found {
+		t.Fatal("no packets decoded")
+	}
+}
+
+func TestSNR(t *testing.T) {
+	cfg := scm.NewPacketConfig(SymbolLength)
+	d := decode.NewDecoder(cfg)
+
+	iq := testutil.Synthesize(cfg, testutil.NewSCMPacket(12345678, 1000), cfg.BlockSize2, rand.New(rand.NewSource(1)))
+
+	// Noise is added to both inphase and quadrature components.
+	expected := 10 * math.Log10(testutil.Amplitude*testutil.Amplitude/(2*testutil.NoiseLevel*testutil.NoiseLevel))
+
+	found := false
+	for idx := 0; idx+cfg.BlockSize2 <= len(iq); idx += cfg.BlockSize2 {
+		for _, pkt := range d.Decode(iq[idx : idx+cfg.BlockSize2]) {
+			snr, ok := d.SNR(pkt)
+			if !ok {
+				t.Fatalf("packet %02X not found", pkt)
+			}
+			if math.Abs(snr-expected) > 1 {
+				t.Errorf("expected %0.1f dB, got %0.1f dB", expected, snr)
+			}
+			found = true
+		}
+	}
+
+	if !found {
+		t.Fatal("no packets decoded")
+	}
+}
+
+// Packets of noise may have more power in their off halves than their on
+// halves, which is reported as no signal rather than NaN.
+func TestSNRNoise(t *testing.T) {
+	cfg := scm.NewPacketConfig(SymbolLength)
+	d := decode.NewDecoder(cfg, decode.WithThreshold(0))
+
+	iq := testutil.Synthesize(cfg, nil, cfg.BlockSize2, rand.New(rand.NewSource(1)))
+
+	// With no threshold noise decodes as many packets, one is enough.
+	pkts := d.Decode(iq[:cfg.BlockSize2])
+	if len(pkts) == 0 {
+		t.Fatal("no packets decoded")
+	}
+
+	snr, ok := d.SNR(pkts[0])
+	if !ok {
+		t.Fatalf("packet %02X not found", pkts[0])
+	}
+	if math.IsNaN(snr) {
+		t.Fatalf("packet %02X: expected a number, got NaN", pkts[0])
+	}
+}
+
+// A packet with a corrupted preamble symbol is only found when the threshold
+// tolerates it.
+func TestWithThreshold(t *testing.T) {
+	cfg := scm.NewPacketConfig(SymbolLength)
+
+	pkt := testutil.NewSCMPacket(12345678, 1000)
+	pkt[0] ^= 0x08
+	iq := testutil.Synthesize(cfg, pkt, cfg.BlockSize2, rand.New(rand.NewSource(1)))
+
+	for _, tc := range []struct {
+		opts  []decode.Option
+		found bool
+	}{
+		{nil, false},
+		{[]decode.Option{decode.WithThreshold(1)}, false},
+		{[]decode.Option{decode.WithThreshold(0.9)}, true},
+	} {
+		if pkts := DecodeAll(decode.NewDecoder(cfg, tc.opts...), iq); (len(pkts) > 0) != tc.found {
+			t.Errorf("%d options: expected found %v, got %d packets", len(tc.opts), tc.found, len(pkts))
+		}
+	}
+
+	for _, threshold := range []float64{-0.1, 1.1, math.NaN()} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("threshold %v: expected panic", threshold)
+				}
+			}()
+			decode.WithThreshold(threshold)
+		}()
+	}
+}
+
+// AGC normalizes the signal level: a weak and a strong packet both decode
+// and their filtered signals peak at about the same level, where without
+// AGC the peak follows the input amplitude.
+func TestWithAGC(t *testing.T) {
+	cfg := scm.NewPacketConfig(SymbolLength)
+	iq := testutil.Synthesize(cfg, testutil.NewSCMPacket(12345678, 1000), cfg.BlockSize2, rand.New(rand.NewSource(1)))
+
+	// Scale the samples about their center.
+	scaled := func(scale float64) []byte {
+		out := make([]byte, len(iq))
+		for idx, v := range iq {
+			out[idx] = testutil.Clip(127.4 + (float64(v)-127.4)*scale)
+		}
+		return out
+	}
+
+	// Returns the peak filtered signal, failing if the packet isn't found.
+	peak := func(scale float64, opts ...decode.Option) (peak float64) {
+		d := decode.NewDecoder(cfg, opts...)
+		samples := scaled(scale)
+
+		found := false
+		for idx := 0; idx+cfg.BlockSize2 <= len(samples); idx += cfg.BlockSize2 {
+			found = len(d.Decode(samples[idx:idx+cfg.BlockSize2])) > 0 || found
+			for _, v := range d.Signal {
+				peak = math.Max(peak, v)
+			}
+		}
+		if !found {
+			t.Errorf("scale %0.2f with %d options: packet not found", scale, len(opts))
+		}
+		return
+	}
+
+	if ratio := peak(1) / peak(0.25); ratio < 3 {
+		t.Errorf("expected peaks without agc to follow amplitude, got ratio %0.2f", ratio)
+	}
+
+	agc := decode.WithAGC(0.5, 0.001)
+	if ratio := peak(1, agc) / peak(0.25, agc); ratio < 0.8 || ratio > 1.25 {
+		t.Errorf("expected peaks with agc to match, got ratio %0.2f", ratio)
+	}
+
+	for _, rates := range [][2]float64{{0, 0.5}, {0.5, 0}, {1.5, 0.5}, {0.5, math.NaN()}} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("rates %v: expected panic", rates)
+				}
+			}()
+			decode.WithAGC(rates[0], rates[1])
+		}()
+	}
+}
+
+func TestDecodeStream(t *testing.T) {
+	cfg := scm.NewPacketConfig(SymbolLength)
+	rng := rand.New(rand.NewSource(1))
+
+	var iq []byte
+	for id := uint32(1); id <= 3; id++ {
+		iq = append(iq, testutil.Synthesize(cfg, testutil.NewSCMPacket(id, id*10), cfg.BlockSize2, rng)...)
+	}
+	expected := DecodeAll(decode.NewDecoder(cfg), iq)
+	if len(expected) == 0 {
+		t.Fatal("no packets decoded")
+	}
+
+	// Every packet is sent before io.EOF, a trailing partial block is
+	// ignored.
+	out := make(chan []byte, len(expected))
+	err := decode.NewDecoder(cfg).DecodeStream(context.Background(), bytes.NewReader(append(iq, 1, 2, 3)), out)
+	if err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+	close(out)
+
+	var pkts [][]byte
+	for pkt := range out {
+		pkts = append(pkts, pkt)
+	}
+	if !reflect.DeepEqual(pkts, expected) {
+		t.Errorf("expected packets %02X, got %02X", expected, pkts)
+	}
+}
+
+func TestDecodeStreamCancel(t *testing.T) {
+	cfg := scm.NewPacketConfig(SymbolLength)
+	iq := testutil.Synthesize(cfg, testutil.NewSCMPacket(12345678, 1000), cfg.BlockSize2, rand.New(rand.NewSource(1)))
+
+	// Cancelled before reading.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := decode.NewDecoder(cfg).DecodeStream(ctx, bytes.NewReader(iq), make(chan []byte)); err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+
+	// Cancelled while blocked sending a packet nobody receives.
+	ctx, cancel = context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- decode.NewDecoder(cfg).DecodeStream(ctx, bytes.NewReader(iq), make(chan []byte))
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Errorf("expected context.Canceled, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("DecodeStream did not return after cancellation")
+	}
+}
+
+func TestStreamDecoderNext(t *testing.T) {
+	cfg := scm.NewPacketConfig(SymbolLength)
+	p := scm.NewParser()
+
+	const id = 12345678
+	iq := testutil.Synthesize(cfg, testutil.NewSCMPacket(id, 1000), cfg.BlockSize2, rand.New(rand.NewSource(1)))
+
+	// A trailing partial block is treated as the end of the stream.
+	sd := decode.NewStreamDecoder(bytes.NewReader(append(iq, 1, 2, 3)), cfg)
+
+	found := false
+	for {
+		pkt, err := sd.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		msg, err := p.Parse(parse.NewDataFromBytes(pkt))
+		if err == nil && msg.MeterID() == id {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("expected the synthesized packet before io.EOF")
+	}
+
+	// The stream stays exhausted.
+	if _, err := sd.Next(); err != io.EOF {
+		t.Errorf("expected io.EOF, got %v", err)
+	}
+
+	// Silence decodes to nothing.
+	sd = decode.NewStreamDecoder(bytes.NewReader(make([]byte, 4*cfg.BlockSize2)), cfg)
+	if pkt, err := sd.Next(); err != io.EOF {
+		t.Errorf("expected io.EOF, got %02X, %v", pkt, err)
+	}
+}
+
+func TestCorrelate(t *testing.T) {
+	cfg := scm.NewPacketConfig(SymbolLength)
+
+	const gap = 1000
+	iq := testutil.Synthesize(cfg, testutil.NewSCMPacket(12345678, 1000), gap, rand.New(rand.NewSource(1)))
+
+	mag := make([]float64, len(iq)>>1)
+	decode.NewSqrtMagLUT().Execute(iq, mag)
+
+	signal := make([]float32, len(mag))
+	for idx, v := range mag {
+		signal[idx] = float32(v)
+	}
+
+	peaks := decode.Correlator{Threshold: 0.9}.Correlate(signal, cfg.PreambleTemplate())
+	if len(peaks) != 1 {
+		t.Fatalf("expected 1 peak, got %d: %+v", len(peaks), peaks)
+	}
+	if peaks[0].Offset != gap {
+		t.Errorf("expected peak at offset %d, got %d", gap, peaks[0].Offset)
+	}
+}
+
+// The alpha max plus beta min approximation used by -fastmag underestimates
+// the true magnitude by at most 1-α, about 5.2%, where one component is zero
+// or both are equal.
+func TestFastMagError(t *testing.T) {
+	const (
+		pairs    = 10000
+		maxError = 0.052
+	)
+
+	rng := rand.New(rand.NewSource(1))
+	iq := make([]byte, pairs<<1)
+	rng.Read(iq)
+
+	exact := make([]float64, pairs)
+	approx := make([]float64, pairs)
+	decode.NewSqrtMagLUT().Execute(iq, exact)
+	decode.NewAlphaMaxBetaMinLUT().Execute(iq, approx)
+
+	for idx := range exact {
+		if relErr := math.Abs(approx[idx]-exact[idx]) / exact[idx]; relErr >= maxError {
+			t.Fatalf("I:%d Q:%d expected %f, got %f: relative error %0.2f%%",
+				iq[idx<<1], iq[idx<<1+1], exact[idx], approx[idx], relErr*100,
+			)
+		}
+	}
+}
+
+func TestDecodeWithOffsets(t *testing.T) {
+	cfg := scm.NewPacketConfig(SymbolLength)
+
+	for _, gap := range []int{cfg.BlockSize, cfg.BlockSize + 1000, 3*cfg.BlockSize - 7} {
+		d := decode.NewDecoder(cfg)
+		iq := testutil.Synthesize(cfg, testutil.NewSCMPacket(12345678, 1000), gap, rand.New(rand.NewSource(1)))
+
+		var results []decode.PacketResult
+		for idx := 0; idx+cfg.BlockSize2 <= len(iq); idx += cfg.BlockSize2 {
+			for _, result := range d.DecodeWithOffsets(iq[idx : idx+cfg.BlockSize2]) {
+				// Offset in samples from the start of the synthesized signal.
+				result.BlockOffset += idx >> 1
+				results = append(results, result)
+			}
+		}
+
+		// Packets straddling a block boundary may be found in both blocks.
+		if len(results) == 0 {
+			t.Fatalf("gap %d: no packets decoded", gap)
+		}
+		for _, result := range results {
+			if offset := result.BlockOffset; offset < gap-cfg.SymbolLength || offset > gap+cfg.SymbolLength {
+				t.Errorf("gap %d: expected packet at sample %d, got %d", gap, gap, offset)
+			}
+			if result.Score != 1 {
+				t.Errorf("gap %d: expected score 1, got %f", gap, result.Score)
+			}
+		}
+	}
+}
+
+func TestSlidingWindow(t *testing.T) {
+	cfg := scm.NewPacketConfig(SymbolLength)
+	iq := NewSampleFile(cfg)[:cfg.BlockSize2*512]
+
+	// Packets within a block are found in a different order, compare sorted.
+	decodeSorted := func(d decode.Decoder) (pkts []string) {
+		for _, pkt := range DecodeAll(d, iq) {
+			pkts = append(pkts, fmt.Sprintf("%02X", pkt))
+		}
+		sort.Strings(pkts)
+		return
+	}
+
+	block := decodeSorted(decode.NewDecoder(cfg))
+	sliding := decodeSorted(decode.NewDecoder(cfg, decode.WithSlidingWindow()))
+
+	if len(block) == 0 {
+		t.Fatal("no packets decoded")
+	}
+	if !reflect.DeepEqual(sliding, block) {
+		t.Errorf("expected %d packets %s, got %d packets %s", len(block), block, len(sliding), sliding)
+	}
+}
+
+func BenchmarkDecodeFile(b *testing.B) {
+	cfg := scm.NewPacketConfig(SymbolLength)
+	iq := NewSampleFile(cfg)
+	iq = iq[:len(iq)-len(iq)%cfg.BlockSize2]
+
+	d := decode.NewDecoder(cfg)
+	p := scm.NewParser()
+
+	found := 0
+	for _, pkt := range DecodeAll(d, iq) {
+		if _, err := p.Parse(parse.NewDataFromBytes(pkt)); err == nil {
+			found++
+		}
+	}
+	if found == 0 {
+		b.Fatal("no packets decoded from sample file")
+	}
+
+	b.SetBytes(int64(len(iq)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		DecodeAll(d, iq)
+	}
+}
+
+// Decode latency (ns/op) and throughput (MB/s) at multiples of the default
+// block size.
+func BenchmarkDecodeBlockSize(b *testing.B) {
+	for _, factor := range []int{1, 2, 4} {
+		cfg := idm.NewPacketConfig(SymbolLength)
+		if err := cfg.SetBlockSize(cfg.BlockSize2 * factor); err != nil {
+			b.Fatal(err)
+		}
+
+		b.Run(strconv.Itoa(factor)+"x", func(b *testing.B) {
+			d := decode.NewDecoder(cfg)
+
+			block := make([]byte, cfg.BlockSize2)
+			rand.New(rand.NewSource(1)).Read(block)
+
+			b.SetBytes(int64(cfg.BlockSize2))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				d.Decode(block)
+			}
+		})
+	}
+}
+
+// Decode throughput and the number of packets found with each search
+// method, from synthesized samples with packets straddling block boundaries.
+func BenchmarkSlidingWindow(b *testing.B) {
+	cfg := scm.NewPacketConfig(SymbolLength)
+
+	// Gaps which aren't a multiple of the block size shift successive
+	// packets relative to block boundaries.
+	rng := rand.New(rand.NewSource(1))
+	var iq []byte
+	for id := uint32(1); id <= 64; id++ {
+		iq = append(iq, testutil.Synthesize(cfg, testutil.NewSCMPacket(id, id*10), cfg.BlockSize+int(id)*7, rng)...)
+	}
+	iq = append(iq, make([]byte, cfg.BufferLength<<1)...)
+	iq = iq[:len(iq)-len(iq)%cfg.BlockSize2]
+
+	p := scm.NewParser()
+
+	for _, test := range []struct {
+		name string
+		opts []decode.Option
+	}{
+		{"block", nil},
+		{"sliding", []decode.Option{decode.WithSlidingWindow()}},
+	} {
+		b.Run(test.name, func(b *testing.B) {
+			d := decode.NewDecoder(cfg, test.opts...)
+
+			found := 0
+			for _, pkt := range DecodeAll(d, iq) {
+				if _, err := p.Parse(parse.NewDataFromBytes(pkt)); err == nil {
+					found++
+				}
+			}
+
+			b.SetBytes(int64(len(iq)))
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				DecodeAll(d, iq)
+			}
+			b.ReportMetric(float64(found), "packets")
+		})
+	}
+}
+
+func TestDecimate(t *testing.T) {
+	input := []byte{
+		10, 200, 11, 201, 13, 203,
+		0, 255, 1, 254, 2, 255,
+	}
+	expected := []byte{11, 201, 1, 255}
+
+	output := make([]byte, len(input)/3)
+	decode.Decimate(input, output, 3)
+	if !reflect.DeepEqual(output, expected) {
+		t.Errorf("expected %v, got %v", expected, output)
+	}
+}
+
+// Packets synthesized at a multiple of the sample rate decode once
+// decimated, including to rates the dongle doesn't support.
+func TestDecimateDecode(t *testing.T) {
+	const id = 12345678
+	cfg := scm.NewPacketConfig(SymbolLength - 1)
+
+	iq := testutil.Synthesize(cfg, testutil.NewSCMPacket(id, 1000), cfg.BlockSize2, rand.New(rand.NewSource(1)))
+	iq = append(iq, make([]byte, cfg.BufferLength<<1)...)
+
+	p := scm.NewParser()
+	for _, factor := range []int{2, 4} {
+		decimated := scm.NewPacketConfig((SymbolLength - 1) / factor)
+
+		input := iq[:len(iq)-len(iq)%(decimated.BlockSize2*factor)]
+		output := make([]byte, len(input)/factor)
+		decode.Decimate(input, output, factor)
+
+		found := false
+		for _, pkt := range DecodeAll(decode.NewDecoder(decimated), output) {
+			msg, err := p.Parse(parse.NewDataFromBytes(pkt))
+			if err == nil && msg.MeterID() == id {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("factor %d: packet not decoded after decimation", factor)
+		}
+	}
+}
+
+// Packets riding on a large DC offset decode with the DC block enabled.
+func TestDCBlock(t *testing.T) {
+	const (
+		id     = 12345678
+		offset = 48
+	)
+	cfg := scm.NewPacketConfig(SymbolLength)
+
+	iq := testutil.Synthesize(cfg, testutil.NewSCMPacket(id, 1000), cfg.BlockSize2, rand.New(rand.NewSource(1)))
+	iq = append(iq, make([]byte, cfg.BufferLength<<1)...)
+	for idx := range iq {
+		iq[idx] = testutil.Clip(float64(iq[idx]) + offset)
+	}
+
+	for _, fastMag := range []bool{false, true} {
+		opts := []decode.Option{decode.WithDCBlock()}
+		if fastMag {
+			opts = append(opts, decode.WithFastMag())
+		}
+
+		p := scm.NewParser()
+		found := false
+		for _, pkt := range DecodeAll(decode.NewDecoder(cfg, opts...), iq) {
+			msg, err := p.Parse(parse.NewDataFromBytes(pkt))
+			if err == nil && msg.MeterID() == id {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("fastMag=%v: packet not decoded with DC block", fastMag)
+		}
+	}
+}
+
+func TestCorrelationRecorder(t *testing.T) {
+	cfg := scm.NewPacketConfig(SymbolLength)
+
+	iq := testutil.Synthesize(cfg, testutil.NewSCMPacket(12345678, 1000), cfg.BlockSize2, rand.New(rand.NewSource(1)))
+	iq = append(iq, make([]byte, cfg.BufferLength<<1)...)
+
+	var buf bytes.Buffer
+	d := decode.NewDecoder(cfg, decode.WithCorrelationRecorder(&buf))
+	pkts := DecodeAll(d, iq)
+	if d.CorrelationErr() != nil {
+		t.Fatal(d.CorrelationErr())
+	}
+
+	blocks := len(iq) / cfg.BlockSize2
+	if buf.Len() != blocks*cfg.BlockSize*4 {
+		t.Fatalf("expected %d bytes, got %d", blocks*cfg.BlockSize*4, buf.Len())
+	}
+
+	var peak float32
+	scores := make([]float32, buf.Len()/4)
+	if err := binary.Read(&buf, binary.LittleEndian, scores); err != nil {
+		t.Fatal(err)
+	}
+	for _, score := range scores {
+		if score < 0 || score > 1 {
+			t.Fatalf("score %f out of range", score)
+		}
+		if score > peak {
+			peak = score
+		}
+	}
+
+	if len(pkts) == 0 || peak != 1 {
+		t.Errorf("expected a packet and peak score of 1, got %d packets and %f", len(pkts), peak)
+	}
+}
+
+// Power of IQ samples relative to their DC level, after skipping the filter's
+// transient.
+func tonePower(iq []byte) (power float64) {
+	iq = iq[2000:]
+	for _, v := range iq {
+		s := float64(v) - 127.5
+		power += s * s
+	}
+	return power / float64(len(iq)>>1)
+}
+
+func TestNotch(t *testing.T) {
+	const (
+		sampleRate = 2359296
+		offset     = 150000
+		width      = 10000
+	)
+
+	tone := func(freq float64) (iq []byte) {
+		for idx := 0; idx < 1<<16; idx++ {
+			phase := 2 * math.Pi * freq * float64(idx) / sampleRate
+			iq = append(iq, testutil.Clip(127.5+50*math.Cos(phase)), testutil.Clip(127.5+50*math.Sin(phase)))
+		}
+		return
+	}
+
+	tests := []struct {
+		freq     float64
+		minAtten float64
+		maxAtten float64
+	}{
+		{offset, 20, math.Inf(1)},
+		{-offset, -1, 1},
+		{offset + 200000, -1, 1},
+	}
+
+	for _, test := range tests {
+		iq := tone(test.freq)
+		before := tonePower(iq)
+		decode.NewNotch(offset, width, sampleRate).Execute(iq)
+		atten := 10 * math.Log10(before/tonePower(iq))
+
+		if atten < test.minAtten || atten > test.maxAtten {
+			t.Errorf("%0.0f Hz: expected attenuation between %0.0f and %0.0f dB, got %0.1f dB", test.freq, test.minAtten, test.maxAtten, atten)
+		}
+	}
+}
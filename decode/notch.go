@@ -0,0 +1,61 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2014 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package decode
+
+import (
+	"math"
+	"math/cmplx"
+)
+
+// Notch is a first order complex IIR notch filter which removes a narrowband
+// signal at a frequency offset from the center of 8-bit IQ samples. Filter
+// state carries across blocks.
+type Notch struct {
+	zero, pole      complex128
+	prevIn, prevOut complex128
+}
+
+// NewNotch returns a notch at the given offset from the center frequency in
+// Hz with roughly the given -3 dB width in Hz, for samples at sampleRate.
+func NewNotch(offset, width float64, sampleRate int) *Notch {
+	w := 2 * math.Pi * offset / float64(sampleRate)
+
+	// The pole's distance from the unit circle sets the width of the notch.
+	r := math.Max(0, 1-math.Pi*width/float64(sampleRate))
+
+	return &Notch{
+		zero: cmplx.Rect(1, w),
+		pole: cmplx.Rect(r, w),
+	}
+}
+
+// Filters the given interleaved IQ samples in place.
+func (n *Notch) Execute(iq []byte) {
+	for idx := 0; idx+1 < len(iq); idx += 2 {
+		x := complex(float64(iq[idx])-127.5, float64(iq[idx+1])-127.5)
+		y := x - n.zero*n.prevIn + n.pole*n.prevOut
+		n.prevIn, n.prevOut = x, y
+
+		iq[idx] = clip(real(y) + 127.5)
+		iq[idx+1] = clip(imag(y) + 127.5)
+	}
+}
+
+// Rounds and clamps v to a sample value.
+func clip(v float64) byte {
+	return byte(math.Max(0, math.Min(255, math.Floor(v+0.5))))
+}
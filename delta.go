@@ -0,0 +1,92 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2014 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"github.com/bemasher/rtlamr/idm"
+	"github.com/bemasher/rtlamr/parse"
+	"github.com/bemasher/rtlamr/scm"
+)
+
+// DeltaTracker replaces cumulative consumption with the consumption since
+// the previous message from the same meter.
+type DeltaTracker struct {
+	skipFirst bool
+	last      map[uint32]uint32
+}
+
+func NewDeltaTracker(skipFirst bool) *DeltaTracker {
+	return &DeltaTracker{skipFirst, make(map[uint32]uint32)}
+}
+
+// Apply returns msg with its consumption replaced by the difference from the
+// last recorded reading of the same meter. The first reading from a meter has
+// a delta of 0 and is skipped, returning false, if skipFirst is set. Registers
+// which roll over produce the delta modulo the size of the register. A delta
+// of more than half the register can't be a rollover, it's usually a reading
+// just below the last from a meter being reset or replaced, so it restarts
+// from the reading as if it were the first. Apply doesn't record the
+// reading, call Record once it's known whether the message is written.
+func (dt *DeltaTracker) Apply(msg parse.Message) (parse.Message, bool) {
+	switch m := msg.(type) {
+	case scm.SCM:
+		// SCM consumption is a 24-bit register.
+		delta, ok := dt.delta(m.MeterID(), m.Consumption, 1<<24-1)
+		m.Consumption = delta
+		return m, ok
+	case idm.IDM:
+		delta, ok := dt.delta(m.MeterID(), m.LastConsumptionCount, 1<<32-1)
+		m.LastConsumptionCount = delta
+		return m, ok
+	}
+
+	return msg, true
+}
+
+// Record makes msg's cumulative consumption the reading later deltas of the
+// same meter are taken from.
+func (dt *DeltaTracker) Record(msg parse.Message) {
+	if c, ok := consumption(msg); ok {
+		dt.last[msg.MeterID()] = c
+	}
+}
+
+// Returns the cumulative consumption of messages which report one.
+func consumption(msg parse.Message) (uint32, bool) {
+	switch m := msg.(type) {
+	case scm.SCM:
+		return m.Consumption, true
+	case idm.IDM:
+		return m.LastConsumptionCount, true
+	}
+
+	return 0, false
+}
+
+func (dt *DeltaTracker) delta(id, consumption, mask uint32) (uint32, bool) {
+	last, seen := dt.last[id]
+	if !seen {
+		return 0, !dt.skipFirst
+	}
+
+	delta := (consumption - last) & mask
+	if delta > mask>>1 {
+		return 0, !dt.skipFirst
+	}
+
+	return delta, true
+}
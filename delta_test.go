@@ -0,0 +1,88 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/bemasher/rtlamr/idm"
+	"github.com/bemasher/rtlamr/parse"
+	"github.com/bemasher/rtlamr/scm"
+)
+
+func TestDeltaTracker(t *testing.T) {
+	type reading struct {
+		msg   parse.Message
+		delta uint32
+		ok    bool
+	}
+
+	testCases := []struct {
+		name      string
+		skipFirst bool
+		readings  []reading
+	}{
+		{"first reading", false, []reading{
+			{scm.SCM{ID: 1, Consumption: 1000}, 0, true},
+		}},
+		{"normal delta", false, []reading{
+			{scm.SCM{ID: 1, Consumption: 1000}, 0, true},
+			{scm.SCM{ID: 1, Consumption: 1025}, 25, true},
+			{scm.SCM{ID: 1, Consumption: 1025}, 0, true},
+		}},
+		{"meters tracked separately", false, []reading{
+			{scm.SCM{ID: 1, Consumption: 1000}, 0, true},
+			{scm.SCM{ID: 2, Consumption: 5000}, 0, true},
+			{scm.SCM{ID: 1, Consumption: 1010}, 10, true},
+			{scm.SCM{ID: 2, Consumption: 5002}, 2, true},
+		}},
+		{"scm rollover", false, []reading{
+			{scm.SCM{ID: 1, Consumption: 1<<24 - 10}, 0, true},
+			{scm.SCM{ID: 1, Consumption: 5}, 15, true},
+		}},
+		{"skip first", true, []reading{
+			{scm.SCM{ID: 1, Consumption: 1000}, 0, false},
+			{scm.SCM{ID: 1, Consumption: 1025}, 25, true},
+			{scm.SCM{ID: 2, Consumption: 1025}, 0, false},
+		}},
+		{"scm reset", false, []reading{
+			{scm.SCM{ID: 1, Consumption: 1000}, 0, true},
+			{scm.SCM{ID: 1, Consumption: 990}, 0, true},
+			{scm.SCM{ID: 1, Consumption: 995}, 5, true},
+		}},
+		{"reset skipped", true, []reading{
+			{scm.SCM{ID: 1, Consumption: 1000}, 0, false},
+			{scm.SCM{ID: 1, Consumption: 0}, 0, false},
+			{scm.SCM{ID: 1, Consumption: 7}, 7, true},
+		}},
+		{"idm", false, []reading{
+			{idm.IDM{ERTSerialNumber: 1, LastConsumptionCount: 100000}, 0, true},
+			{idm.IDM{ERTSerialNumber: 1, LastConsumptionCount: 100042}, 42, true},
+		}},
+		{"idm rollover", false, []reading{
+			{idm.IDM{ERTSerialNumber: 1, LastConsumptionCount: 1<<32 - 1}, 0, true},
+			{idm.IDM{ERTSerialNumber: 1, LastConsumptionCount: 1}, 2, true},
+		}},
+		{"idm reset", false, []reading{
+			{idm.IDM{ERTSerialNumber: 1, LastConsumptionCount: 100000}, 0, true},
+			{idm.IDM{ERTSerialNumber: 1, LastConsumptionCount: 99999}, 0, true},
+		}},
+	}
+
+	for _, tc := range testCases {
+		dt := NewDeltaTracker(tc.skipFirst)
+		for idx, r := range tc.readings {
+			msg, ok := dt.Apply(r.msg)
+			dt.Record(r.msg)
+			if ok != r.ok {
+				t.Errorf("%s: reading %d: expected ok %v, got %v", tc.name, idx, r.ok, ok)
+			}
+
+			delta, _ := consumption(msg)
+			if delta != r.delta {
+				t.Errorf("%s: reading %d: expected delta %d, got %d", tc.name, idx, r.delta, delta)
+			}
+			if msg.MeterID() != r.msg.MeterID() {
+				t.Errorf("%s: reading %d: expected meter %d, got %d", tc.name, idx, r.msg.MeterID(), msg.MeterID())
+			}
+		}
+	}
+}
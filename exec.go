@@ -0,0 +1,128 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2014 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/bemasher/rtlamr/parse"
+)
+
+// Runs the given command split on whitespace, without a shell, and waits for
+// it to exit. Its output is passed through to rtlamr's.
+func runCommand(command string) error {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return errors.New("empty command")
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// ExecSink pipes each message encoded as a line of JSON to the stdin of an
+// external command. The command is either run once per message or, if
+// persistent, started once and kept running. A persistent command found to
+// have exited when a message is written is restarted.
+type ExecSink struct {
+	name       string
+	args       []string
+	persistent bool
+
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+}
+
+func NewExecSink(command string, persistent bool) (*ExecSink, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil, errors.New("empty command")
+	}
+
+	sink := &ExecSink{name: command, args: args, persistent: persistent}
+	if persistent {
+		return sink, sink.start()
+	}
+
+	return sink, nil
+}
+
+func (sink *ExecSink) command() *exec.Cmd {
+	cmd := exec.Command(sink.args[0], sink.args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd
+}
+
+func (sink *ExecSink) start() (err error) {
+	sink.cmd = sink.command()
+	sink.stdin, err = sink.cmd.StdinPipe()
+	if err != nil {
+		return
+	}
+	return sink.cmd.Start()
+}
+
+// Write runs the command with msg on its stdin, or writes msg to the
+// persistent command's stdin, restarting it if the write fails.
+func (sink *ExecSink) Write(msg parse.LogMessage) error {
+	// Encoded like json output, so -field-map applies.
+	var buf bytes.Buffer
+	if err := WriteMessage(&buf, NewEncoder("json", &buf), msg); err != nil {
+		return err
+	}
+
+	if sink.persistent {
+		if _, err := sink.stdin.Write(buf.Bytes()); err == nil {
+			return nil
+		}
+
+		// The command has most likely exited, restart it and write once more.
+		sink.stdin.Close()
+		sink.cmd.Wait()
+		if err := sink.start(); err != nil {
+			return err
+		}
+		_, err := sink.stdin.Write(buf.Bytes())
+		return err
+	}
+
+	cmd := sink.command()
+	cmd.Stdin = &buf
+	return cmd.Run()
+}
+
+// Close closes the persistent command's stdin and waits for it to exit.
+func (sink *ExecSink) Close() error {
+	if !sink.persistent {
+		return nil
+	}
+
+	sink.stdin.Close()
+	return sink.cmd.Wait()
+}
+
+func (sink *ExecSink) String() string {
+	return "exec:" + sink.name
+}
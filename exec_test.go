@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/bemasher/rtlamr/parse"
+	"github.com/bemasher/rtlamr/scm"
+)
+
+// Returns the meter ids of messages written by cat to stdout, which is
+// replaced by a temporary file until the returned function is called.
+func captureStdout(t *testing.T) (ids func() []uint32, restore func()) {
+	f, err := ioutil.TempFile("", "rtlamr")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stdout := os.Stdout
+	os.Stdout = f
+
+	ids = func() (got []uint32) {
+		if _, err := f.Seek(0, 0); err != nil {
+			t.Fatal(err)
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var rm replayMessage
+			if err := json.Unmarshal(scanner.Bytes(), &rm); err != nil {
+				t.Fatal(err)
+			}
+			var msg scm.SCM
+			if err := json.Unmarshal(rm.Message, &msg); err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, msg.ID)
+		}
+		return
+	}
+	restore = func() {
+		os.Stdout = stdout
+		f.Close()
+		os.Remove(f.Name())
+	}
+	return
+}
+
+func TestExecSink(t *testing.T) {
+	for _, persistent := range []bool{false, true} {
+		func() {
+			ids, restore := captureStdout(t)
+			defer restore()
+
+			sink, err := NewExecSink("cat", persistent)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for id := uint32(1); id <= 3; id++ {
+				if err := sink.Write(parse.LogMessage{Message: scm.SCM{ID: id, Type: 7}}); err != nil {
+					t.Fatalf("persistent %v: %s", persistent, err)
+				}
+			}
+			if err := sink.Close(); err != nil {
+				t.Fatalf("persistent %v: %s", persistent, err)
+			}
+
+			if got := ids(); len(got) != 3 || got[0] != 1 || got[1] != 2 || got[2] != 3 {
+				t.Errorf("persistent %v: expected meters [1 2 3], got %v", persistent, got)
+			}
+		}()
+	}
+}
+
+func TestExecSinkRestart(t *testing.T) {
+	ids, restore := captureStdout(t)
+	defer restore()
+
+	sink, err := NewExecSink("cat", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The next write finds the command gone and restarts it.
+	sink.cmd.Process.Kill()
+	sink.cmd.Wait()
+
+	for id := uint32(1); id <= 2; id++ {
+		if err := sink.Write(parse.LogMessage{Message: scm.SCM{ID: id, Type: 7}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := ids(); len(got) != 2 || got[0] != 1 || got[1] != 2 {
+		t.Errorf("expected meters [1 2], got %v", got)
+	}
+}
@@ -0,0 +1,111 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2014 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// FieldMap is a repeatable flag of JSON field renames, a comma-separated
+// list of the form old:new.
+type FieldMap map[string]string
+
+func (m FieldMap) String() string {
+	var pairs []string
+	for old, name := range m {
+		pairs = append(pairs, old+":"+name)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (m FieldMap) Set(value string) error {
+	for _, pair := range strings.Split(value, ",") {
+		names := strings.SplitN(pair, ":", 2)
+		if len(names) != 2 || names[0] == "" || names[1] == "" {
+			return fmt.Errorf("field map must be of the form old:new: %q", pair)
+		}
+		for old, name := range m {
+			if old != names[0] && name == names[1] {
+				return fmt.Errorf("field map renames %q and %q to %q", old, names[0], name)
+			}
+		}
+		m[names[0]] = names[1]
+	}
+	return nil
+}
+
+// FieldMapEncoder encodes values as JSON with object keys renamed by a field
+// map at every level of nesting. A renamed key replaces a key the object
+// already has of the new name. Keys of each object are written in sorted
+// order.
+type FieldMapEncoder struct {
+	enc    *json.Encoder
+	fields FieldMap
+}
+
+func NewFieldMapEncoder(w io.Writer, fields FieldMap) *FieldMapEncoder {
+	return &FieldMapEncoder{json.NewEncoder(w), fields}
+}
+
+func (fe *FieldMapEncoder) Encode(v interface{}) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	// Decode numbers as json.Number so they're written unchanged.
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.UseNumber()
+
+	var value interface{}
+	if err := dec.Decode(&value); err != nil {
+		return err
+	}
+
+	return fe.enc.Encode(fe.rename(value))
+}
+
+func (fe *FieldMapEncoder) rename(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		// Renamed keys are added last, so the result doesn't depend on map
+		// order when one collides with a key which isn't renamed.
+		renamed := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			if _, ok := fe.fields[key]; !ok {
+				renamed[key] = fe.rename(value)
+			}
+		}
+		for key, value := range v {
+			if name, ok := fe.fields[key]; ok {
+				renamed[name] = fe.rename(value)
+			}
+		}
+		return renamed
+	case []interface{}:
+		for idx, value := range v {
+			v[idx] = fe.rename(value)
+		}
+	}
+	return v
+}
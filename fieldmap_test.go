@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/bemasher/rtlamr/parse"
+	"github.com/bemasher/rtlamr/scm"
+)
+
+func TestFieldMapEncoder(t *testing.T) {
+	fields := make(FieldMap)
+	if err := fields.Set("ID:meter_id,Consumption:value"); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := parse.LogMessage{
+		Time:    time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		Message: scm.SCM{ID: 12345678, Type: 7, Consumption: 1000},
+	}
+
+	var buf bytes.Buffer
+	if err := NewFieldMapEncoder(&buf, fields).Encode(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"Length":0,"Message":{"Checksum":0,"TamperEnc":0,"TamperPhy":0,"Type":7,"meter_id":12345678,"value":1000},"Offset":0,"Time":"2024-01-01T00:00:00Z"}` + "\n"
+	if buf.String() != expected {
+		t.Errorf("expected %s, got %s", expected, buf.String())
+	}
+}
+
+func TestFieldMapSet(t *testing.T) {
+	for _, value := range []string{"", "ID", "ID:", ":id", "ID:id,", "ID:id,Type:id"} {
+		if err := make(FieldMap).Set(value); err == nil {
+			t.Errorf("expected error for %q", value)
+		}
+	}
+}
+
+func TestFieldMapCollision(t *testing.T) {
+	fields := make(FieldMap)
+	if err := fields.Set("ID:Type"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The renamed ID replaces Type however the keys are ordered.
+	msg := scm.SCM{ID: 12345678, Type: 7}
+	for idx := 0; idx < 16; idx++ {
+		var buf bytes.Buffer
+		if err := NewFieldMapEncoder(&buf, fields).Encode(msg); err != nil {
+			t.Fatal(err)
+		}
+
+		expected := `{"Checksum":0,"Consumption":0,"TamperEnc":0,"TamperPhy":0,"Type":12345678}` + "\n"
+		if buf.String() != expected {
+			t.Fatalf("expected %s, got %s", expected, buf.String())
+		}
+	}
+}
@@ -17,46 +17,167 @@
 package main
 
 import (
-	"encoding/gob"
-	"encoding/json"
-	"encoding/xml"
+	"bufio"
+	"compress/gzip"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"math"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
-	"github.com/bemasher/rtlamr/csv"
+	"github.com/bemasher/rtlamr/decode"
+	"github.com/bemasher/rtlamr/parse"
+	"github.com/bemasher/rtlamr/session"
 )
 
+var networkBufferSize = flag.Int("network-buffer-size", 2<<20, "tcp receive buffer size in bytes for the sample connection, 0 for the OS default")
+var tcpNoDelay = flag.Bool("tcp-nodelay", true, "send commands to rtl_tcp immediately instead of coalescing small writes, lower latency at the cost of more packets")
+var keepAlive = flag.Duration("keepalive", 30*time.Second, "interval between tcp keepalives on the sample connection, 0 to disable")
+var ipv4 = flag.Bool("ipv4", false, "connect to rtl_tcp and listen for -listen-addr only over IPv4")
+var ipv6 = flag.Bool("ipv6", false, "connect to rtl_tcp and listen for -listen-addr only over IPv6")
+var connTimeout = flag.Duration("conn-timeout", 10*time.Second, "time to wait for rtl_tcp to accept the connection and send dongle info, 0 to wait indefinitely")
+var readBufferSize = flag.Int("read-buffer-size", 0, "bytes of samples to buffer between reads from the connection and blocks, 0 to read each block directly")
+var replayFilename = flag.String("replay", "", "read messages or samples from this file, - for stdin, instead of receiving, requires -input-format")
+var inputFormat = flag.String("input-format", "", "format of data read by -replay: json or iq")
+var skipBytes = flag.Int64("skip-bytes", 0, "skip this many bytes, must be even, of samples replayed with -input-format=iq")
+var replayLoop = flag.Bool("replay-loop", false, "start samples replayed with -input-format=iq over from the beginning, or the skip offset, at the end of the file")
+var skipDuration = flag.Duration("skip-duration", 0, "skip this much time of samples replayed with -input-format=iq")
+var listenAddr = flag.String("listen-addr", "", "accept one tcp connection streaming raw samples on this address instead of connecting to rtl_tcp")
 var logFilename = flag.String("logfile", "/dev/stdout", "log statement dump file")
 var logFile *os.File
+var gzipOutput = flag.Bool("gzip-output", false, "gzip compress the log file, appending .gz to its name if missing")
+var gzipLevel = flag.Int("gzip-level", gzip.DefaultCompression, "gzip compression level from 1 for fastest to 9 for smallest")
+var gzipWriter *GzipWriter
+
+var outputBuffer = flag.Int("output-buffer", 1, "number of messages to buffer before writing output, 1 for unbuffered")
+var outputPrefix = flag.String("output-prefix", "", "string prepended to each line of output, ignored for xml, gob and protobuf")
+var outputSuffix = flag.String("output-suffix", "", "string appended to each line of output, ignored for xml, gob and protobuf")
+var outputFlushInterval = flag.Duration("output-flush-interval", 0, "write buffered output at least this often, 0 to only write when the buffer is full")
+
+// Messages are written to output, which buffers writes to logFile when
+// -output-buffer is greater than 1.
+var output io.Writer
+var outputBuf *bufio.Writer
 
 var sampleFilename = flag.String("samplefile", os.DevNull, "raw signal dump file")
 var sampleFile *os.File
 
+var recordSession = flag.String("record-session", "", "record dongle info, commands and samples of the rtl_tcp session to this file")
+var sessionFile *os.File
+var sessionWriter *session.Writer
+
+var centerFreqOffset = flag.Int("center-freq-offset", 0, "offset in Hz added to the center frequency")
+
+var sampleRateOverride = flag.Bool("sample-rate-override", false, "suppress warning when -samplerate differs from the rate required by the decoder")
+
 var msgType = flag.String("msgtype", "scm", "message type to receive: scm or idm")
 var fastMag = flag.Bool("fastmag", false, "use faster alpha max + beta min magnitude approximation")
+var downsample = flag.Int("downsample", 1, "receive at this many times the decoder's sample rate and decimate before decoding")
+var notchFreq = flag.Uint("notch-freq", 0, "frequency in Hz of a narrowband interferer to filter out before decoding, 0 to disable")
+var notchWidth = flag.Float64("notch-width", 10000, "width in Hz of the -notch-freq filter")
+var notch *decode.Notch
+
+var symbolLength = SymbolLength{Length: 73}
 
-var symbolLength = flag.Int("symbollength", 73, "symbol length in samples, see -help for valid lengths")
+var channelBuf = flag.Int("channel-buf", 10, "number of sample blocks to buffer between reading and decoding")
 
-var timeLimit = flag.Duration("duration", 0, "time to run for, 0 for infinite, ex. 1h5m10s")
+var networkTimeout = flag.Duration("network-timeout", 0, "deadline for each read and write on the rtl_tcp connection, 0 for no deadline")
+
+var blockSize = flag.Int("block-size", 0, "bytes of samples to read and decode at once, 0 for the size computed from -symbollength")
+
+var timeLimit = flag.Duration("duration", 0, "time to run for, 0 for infinite, ex. 1h5m10s, same as -max-runtime")
+var iqHistogramFilename = flag.String("iq-histogram", "", "write a csv histogram of raw sample values to this file on exit or SIGUSR1")
+var iqHistogram *Histogram
+
+var count = flag.Int("count", 0, "exit after receiving this many messages, 0 for no limit")
+var discover = flag.Bool("discover", false, "output only the id, type and time first seen of each new meter")
+var discovered map[uint32]bool
+
+var exitCodeNoData = flag.Int("exit-code-no-data", 0, "exit status if no messages were received, 0 to exit normally")
 var meterID UintMap
+var meterIDRanges UintRanges
 var meterType UintMap
+var filterTypeName = flag.String("filtertype-name", "", "display only messages matching a commodity in a comma-separated list of names: electric, gas or water")
+var filterIDFilename = flag.String("filterid-file", "", "display only messages matching an id or range of ids listed one per line in a file")
+var filterAfterString = flag.String("filter-after", "", "display only messages received at or after this RFC3339 time")
+var filterBeforeString = flag.String("filter-before", "", "display only messages received before this RFC3339 time")
+var filterAfter, filterBefore time.Time
+
+var splitByMeter = flag.String("split-by-meter", "", "write each meter's messages to a separate file in this directory")
+var splitMaxOpen = flag.Int("split-max-open", 100, "maximum number of per-meter files to keep open at once")
+var splitIdleClose = flag.Duration("split-idle-close", 10*time.Minute, "close per-meter files which haven't been written to in this long")
+var splitWriter *SplitWriter
+
+var execCommand = flag.String("exec", "", "pipe each message as a line of json to the stdin of this command")
+var preRunCmd = flag.String("pre-run-cmd", "", "run this command before receiving and exit if it fails")
+var postRunCmd = flag.String("post-run-cmd", "", "run this command after receiving stops")
+var execPersistent = flag.Bool("exec-persistent", false, "keep one -exec process running and write all messages to its stdin")
+var calibrateMeter = flag.Uint("calibrate-meter", 0, "estimate frequency correction from packets received from this meter id and exit, 0 to disable")
+var calibrator *Calibrator
+
+var delta = flag.Bool("delta", false, "output consumption since the previous message from each meter instead of the cumulative register")
+var deltaSkipFirst = flag.Bool("delta-skip-first", false, "don't output the first message from each meter when -delta is given")
+var deltaTracker *DeltaTracker
+
+var stripZeroConsumption = flag.Bool("strip-zero-consumption", false, "discard messages reporting zero consumption")
+var minSNR = flag.Float64("min-snr", 6, "discard packets with an estimated per-sample signal to noise ratio below this many dB, 0 to disable")
+
+var maxOutputRate = flag.Float64("max-output-rate", 0, "maximum messages per second to output, excess messages are dropped, 0 for unlimited")
+var outputLimiter *TokenBucket
+
+var outputs OutputList
+var tags TagMap
+var fieldMap FieldMap
+var concurrentOutput = flag.Bool("concurrent-output", false, "write each message to -output and -exec sinks in parallel, waiting for all of them before the next message")
+var sinkErrorThreshold = flag.Int("sink-error-threshold", 10, "consecutive errors writing to an -output or -exec before writes are paused, 0 to exit on the first error")
+var sinkCoolDown = flag.Duration("sink-cool-down", time.Minute, "time to pause writes to a failing output before retrying")
+var sinks []Sink
 
 var encoder Encoder
-var format = flag.String("format", "plain", "format to write log messages in: plain, csv, json, xml or gob")
-var gobUnsafe = flag.Bool("gobunsafe", false, "allow gob output to stdout")
+var format = flag.String("format", "plain", "format to write log messages in: plain, csv, json, logfmt, xml, gob or protobuf")
+var includeRaw = flag.Bool("include-raw", false, "include hex-encoded raw packet bytes in json, xml, csv and gob output")
+var logCRCFailures = flag.Bool("log-crc-failures", false, "log the raw bytes, checksum and block offset of packets which fail to parse")
+var noCRCFilter = flag.Bool("no-crc-filter", false, "output packets which fail their checksum, marked by a crc_valid field")
+var validate = flag.Bool("validate", false, "include field sanity warnings in json, xml and gob output")
+var gobUnsafe = flag.Bool("gobunsafe", false, "allow gob and protobuf output to stdout")
+
+var statsInterval = flag.Duration("stats-interval", 0, "log decoder statistics at this interval, 0 to disable")
+
+var maxMemory = flag.Uint("max-memory", 0, "heap in use in MB beyond which output is flushed and garbage collected, exiting if still 10% over after collection, 0 for no limit")
 
+var maxParseErrors = flag.Int("max-parse-errors", 0, "warn after this many consecutive packets fail to parse, 0 for no limit")
+var exitOnMaxParseErrors = flag.Bool("exit-on-max-parse-errors", false, "exit non-zero when -max-parse-errors is reached")
+
+var strictMeterType = flag.Bool("strict-meter-type", false, "discard messages with a meter type code not listed in meters.md")
+
+var signalReport = flag.Bool("signal-report", false, "write periodic json reports of signal power and clipping instead of decoding messages")
+var signalReportInterval = flag.Duration("signal-report-interval", 10*time.Second, "time between -signal-report reports")
+
+var gainSweep = flag.Bool("gain-sweep", false, "receive at each gain step, print packets decoded and signal power at each, then use the best")
+
+var checkSDR = flag.Bool("check-sdr", false, "connect, report the gain count and signal power of a block of samples, and exit")
+var printPreamble = flag.Bool("print-preamble", false, "log the preamble of the message type in binary and hex at startup")
 var quiet = flag.Bool("quiet", false, "suppress printing state information at startup")
+var verboseStartup = flag.Bool("verbose-startup", false, "log the value and source of every flag at startup")
 var single = flag.Bool("single", false, "one shot execution")
 
 func RegisterFlags() {
 	meterID = make(UintMap)
 	meterType = make(UintMap)
+	tags = make(TagMap)
+	fieldMap = make(FieldMap)
 
 	flag.Var(meterID, "filterid", "display only messages matching an id in a comma-separated list of ids.")
+	flag.Var(&symbolLength, "symbollength", "symbol length in samples or auto, see -help for valid lengths")
+	flag.Var(tags, "tag", "static tag of the form key=value added to every message, may be repeated")
+	flag.Var(fieldMap, "field-map", "rename json fields in a comma-separated list of the form old:new, may be repeated")
+	flag.Var(&outputs, "output", "additional output of the form file:path:format, may be repeated")
+	flag.DurationVar(timeLimit, "max-runtime", 0, "time to run for, 0 for infinite, ex. 1h5m10s, same as -duration")
 	flag.Var(meterType, "filtertype", "display only messages matching a type in a comma-separated list of types.")
 
 	// Override default center frequency.
@@ -66,19 +187,78 @@ func RegisterFlags() {
 	centerFreqFlag.Value.Set(centerFreqString)
 
 	rtlamrFlags := map[string]bool{
-		"logfile":      true,
-		"samplefile":   true,
-		"msgtype":      true,
-		"symbollength": true,
-		"duration":     true,
-		"filterid":     true,
-		"filtertype":   true,
-		"format":       true,
-		"gobunsafe":    true,
-		"quiet":        true,
-		"single":       true,
-		"cpuprofile":   true,
-		"fastmag":      true,
+		"logfile":                true,
+		"listen-addr":            true,
+		"replay":                 true,
+		"input-format":           true,
+		"replay-loop":            true,
+		"skip-bytes":             true,
+		"skip-duration":          true,
+		"network-buffer-size":    true,
+		"gain-sweep":             true,
+		"gzip-output":            true,
+		"gzip-level":             true,
+		"samplefile":             true,
+		"record-session":         true,
+		"msgtype":                true,
+		"center-freq-offset":     true,
+		"sample-rate-override":   true,
+		"symbollength":           true,
+		"block-size":             true,
+		"duration":               true,
+		"max-runtime":            true,
+		"filterid":               true,
+		"filtertype":             true,
+		"filterid-file":          true,
+		"filtertype-name":        true,
+		"filter-after":           true,
+		"filter-before":          true,
+		"format":                 true,
+		"split-by-meter":         true,
+		"exec":                   true,
+		"output":                 true,
+		"tag":                    true,
+		"field-map":              true,
+		"concurrent-output":      true,
+		"sink-error-threshold":   true,
+		"sink-cool-down":         true,
+		"max-output-rate":        true,
+		"min-snr":                true,
+		"strip-zero-consumption": true,
+		"delta":                  true,
+		"delta-skip-first":       true,
+		"calibrate-meter":        true,
+		"exec-persistent":        true,
+		"pre-run-cmd":            true,
+		"post-run-cmd":           true,
+		"split-max-open":         true,
+		"split-idle-close":       true,
+		"output-buffer":          true,
+		"output-flush-interval":  true,
+		"gobunsafe":              true,
+		"include-raw":            true,
+		"validate":               true,
+		"no-crc-filter":          true,
+		"iq-histogram":           true,
+		"count":                  true,
+		"discover":               true,
+		"downsample":             true,
+		"notch-freq":             true,
+		"notch-width":            true,
+		"exit-code-no-data":      true,
+		"output-prefix":          true,
+		"output-suffix":          true,
+		"log-crc-failures":       true,
+		"quiet":                  true,
+		"print-preamble":         true,
+		"check-sdr":              true,
+		"verbose-startup":        true,
+		"stats-interval":         true,
+		"single":                 true,
+		"cpuprofile":             true,
+		"channel-buf":            true,
+		"network-timeout":        true,
+		"fastmag":                true,
 	}
 
 	printDefaults := func(validFlags map[string]bool, inclusion bool) {
@@ -105,6 +285,93 @@ func RegisterFlags() {
 func HandleFlags() {
 	var err error
 
+	if *replayFilename != "" {
+		switch strings.ToLower(*inputFormat) {
+		case "json", "iq":
+		default:
+			log.Fatal("-replay requires -input-format=json or -input-format=iq")
+		}
+		if *checkSDR || *gainSweep || *signalReport {
+			log.Fatal("-check-sdr, -gain-sweep and -signal-report measure the dongle, they can't be used with -replay")
+		}
+		// Replayed samples have no receive time, messages decoded from them
+		// are stamped with the wall clock.
+		if strings.ToLower(*inputFormat) == "iq" && (*filterAfterString != "" || *filterBeforeString != "") {
+			log.Fatal("Messages decoded from -input-format=iq are stamped with the current time, -filter-after and -filter-before can't be used with it")
+		}
+	}
+	if *inputFormat != "" && *replayFilename == "" {
+		log.Fatal("-input-format requires -replay")
+	}
+
+	if *skipBytes < 0 || *skipBytes%2 != 0 {
+		log.Fatal("Invalid skip bytes, must be a non-negative even number: ", *skipBytes)
+	}
+	if *skipDuration < 0 {
+		log.Fatal("Invalid skip duration: ", *skipDuration)
+	}
+	if *skipBytes != 0 && *skipDuration != 0 {
+		log.Fatal("Only one of -skip-bytes and -skip-duration may be given")
+	}
+	if *replayLoop {
+		if strings.ToLower(*inputFormat) != "iq" {
+			log.Fatal("-replay-loop requires -input-format=iq")
+		}
+		if *replayFilename == "-" {
+			log.Fatal("Stdin can't be rewound, -replay-loop requires a file")
+		}
+	}
+	if (*skipBytes != 0 || *skipDuration != 0) && strings.ToLower(*inputFormat) != "iq" {
+		log.Fatal("-skip-bytes and -skip-duration require -input-format=iq")
+	}
+
+	if *ipv4 && *ipv6 {
+		log.Fatal("Only one of -ipv4 and -ipv6 may be given")
+	}
+
+	if *maxParseErrors < 0 {
+		log.Fatal("Invalid maximum parse errors: ", *maxParseErrors)
+	}
+	if *exitOnMaxParseErrors && *maxParseErrors == 0 {
+		log.Fatal("-exit-on-max-parse-errors requires -max-parse-errors")
+	}
+
+	if *readBufferSize < 0 {
+		log.Fatal("Invalid read buffer size: ", *readBufferSize)
+	}
+
+	if *connTimeout < 0 {
+		log.Fatal("Invalid connection timeout: ", *connTimeout)
+	}
+
+	if *keepAlive < 0 {
+		log.Fatal("Invalid keepalive interval: ", *keepAlive)
+	}
+
+	if *networkBufferSize < 0 {
+		log.Fatal("Invalid network buffer size: ", *networkBufferSize)
+	}
+
+	if *signalReportInterval <= 0 {
+		log.Fatal("Invalid signal report interval: ", *signalReportInterval)
+	}
+
+	if *gainSweep && *listenAddr != "" {
+		log.Fatal("Gain is set through rtl_tcp, -gain-sweep can't be used with -listen-addr")
+	}
+
+	if *gzipOutput {
+		if *logFilename == "/dev/stdout" {
+			log.Fatal("-gzip-output requires -logfile")
+		}
+		if *gzipLevel != gzip.DefaultCompression && (*gzipLevel < gzip.BestSpeed || *gzipLevel > gzip.BestCompression) {
+			log.Fatal("Invalid gzip level: ", *gzipLevel)
+		}
+		if !strings.HasSuffix(*logFilename, ".gz") {
+			*logFilename += ".gz"
+		}
+	}
+
 	if *logFilename == "/dev/stdout" {
 		logFile = os.Stdout
 	} else {
@@ -113,36 +380,212 @@ func HandleFlags() {
 			log.Fatal("Error creating log file:", err)
 		}
 	}
-	log.SetOutput(logFile)
+
+	// Only messages are compressed. Log statements go to stderr instead,
+	// a fatal error exits without closing the gzip writer and would leave
+	// its message stuck in the compressor.
+	var logWriter io.Writer = logFile
+	if *gzipOutput {
+		gzipWriter, err = NewGzipWriter(logFile, *gzipLevel)
+		if err != nil {
+			log.Fatal("Error creating gzip writer: ", err)
+		}
+		logWriter = gzipWriter
+	} else {
+		log.SetOutput(logFile)
+	}
+
+	if *outputBuffer < 1 {
+		log.Fatal("Invalid output buffer size: ", *outputBuffer)
+	}
+
+	output = logWriter
+	if *outputBuffer > 1 {
+		outputBuf = bufio.NewWriterSize(logWriter, 1<<16)
+		output = outputBuf
+	}
 
 	sampleFile, err = os.Create(*sampleFilename)
 	if err != nil {
 		log.Fatal("Error creating sample file:", err)
 	}
 
+	if *filterIDFilename != "" {
+		err = meterIDRanges.ReadFile(*filterIDFilename)
+		if err != nil {
+			log.Fatal("Error reading filterid file:", err)
+		}
+	}
+
+	if *filterTypeName != "" {
+		for _, name := range strings.Split(strings.ToLower(*filterTypeName), ",") {
+			codes := parse.MeterTypeCodes(strings.TrimSpace(name))
+			if len(codes) == 0 {
+				log.Fatalf("Invalid meter type name: %q, valid names: %s\n", name, strings.Join(parse.MeterTypeNames(), ", "))
+			}
+			for _, code := range codes {
+				meterType[uint(code)] = true
+			}
+		}
+	}
+
+	if *filterAfterString != "" {
+		filterAfter, err = time.Parse(time.RFC3339, *filterAfterString)
+		if err != nil {
+			log.Fatal("Invalid filter-after time: ", err)
+		}
+	}
+
+	if *filterBeforeString != "" {
+		filterBefore, err = time.Parse(time.RFC3339, *filterBeforeString)
+		if err != nil {
+			log.Fatal("Invalid filter-before time: ", err)
+		}
+	}
+
+	if !filterAfter.IsZero() && !filterBefore.IsZero() && !filterBefore.After(filterAfter) {
+		log.Fatal("Invalid time window: filter-before must be after filter-after")
+	}
+
+	if *notchWidth <= 0 {
+		log.Fatal("Invalid notch width: ", *notchWidth)
+	}
+
+	if *downsample < 1 {
+		log.Fatal("Invalid downsample factor: ", *downsample)
+	}
+
+	if *channelBuf < 0 {
+		log.Fatal("Invalid channel buffer size: ", *channelBuf)
+	}
+
+	if *recordSession != "" {
+		sessionFile, err = os.Create(*recordSession)
+		if err != nil {
+			log.Fatal("Error creating session file:", err)
+		}
+		sessionWriter = session.NewWriter(sessionFile)
+	}
+
 	*format = strings.ToLower(*format)
-	switch *format {
-	case "plain":
-		break
-	case "csv":
-		encoder = csv.NewEncoder(logFile)
-	case "json":
-		encoder = json.NewEncoder(logFile)
-	case "xml":
-		encoder = xml.NewEncoder(logFile)
-	case "gob":
-		encoder = gob.NewEncoder(logFile)
-		if !*gobUnsafe && *logFilename == "/dev/stdout" {
-			fmt.Println("Gob encoded messages are not stdout safe, specify non-stdout -logfile or use -gobunsafe.")
-			os.Exit(1)
+
+	// XML, gob and protobuf output aren't line oriented.
+	if (*outputPrefix != "" || *outputSuffix != "") && *format != "xml" && *format != "gob" && *format != "protobuf" {
+		output = NewLineWriter(output, *outputPrefix, *outputSuffix)
+	}
+
+	encoder = NewEncoder(*format, output)
+
+	if *iqHistogramFilename != "" {
+		iqHistogram = new(Histogram)
+	}
+
+	if *count < 0 {
+		log.Fatal("Invalid message count: ", *count)
+	}
+
+	if *discover {
+		discovered = make(map[uint32]bool)
+	}
+
+	if *delta {
+		deltaTracker = NewDeltaTracker(*deltaSkipFirst)
+	}
+
+	if *maxOutputRate < 0 {
+		log.Fatal("Invalid maximum output rate: ", *maxOutputRate)
+	}
+	if *maxOutputRate > 0 {
+		// Allow bursts of up to one second's worth of messages.
+		outputLimiter = NewTokenBucket(*maxOutputRate, int(math.Max(1, *maxOutputRate)))
+	}
+
+	sinks, err = outputs.Sinks()
+	if err != nil {
+		log.Fatal("Error creating output:", err)
+	}
+
+	if *execCommand != "" {
+		execSink, err := NewExecSink(*execCommand, *execPersistent)
+		if err != nil {
+			log.Fatal("Error starting exec command:", err)
+		}
+		sinks = append(sinks, execSink)
+	}
+
+	if *sinkErrorThreshold < 0 {
+		log.Fatal("Invalid sink error threshold: ", *sinkErrorThreshold)
+	}
+	if *sinkErrorThreshold > 0 {
+		for idx, sink := range sinks {
+			sinks[idx] = NewBreakerSink(sink, *sinkErrorThreshold, *sinkCoolDown)
+		}
+	}
+
+	if *splitByMeter != "" {
+		if *splitMaxOpen < 1 {
+			log.Fatal("Invalid maximum number of open split files: ", *splitMaxOpen)
+		}
+		// Gob streams start with type definitions, a file reopened to append
+		// more would repeat them and fail to decode.
+		if *format == "gob" {
+			log.Fatal("Split files are reopened to append to them, -split-by-meter can't be used with -format=gob")
 		}
+		splitWriter = NewSplitWriter(*splitByMeter, *format, *splitMaxOpen)
 	}
+	if (*format == "gob" || *format == "protobuf") && !*gobUnsafe && *logFilename == "/dev/stdout" {
+		fmt.Printf("%s encoded messages are not stdout safe, specify non-stdout -logfile or use -gobunsafe.\n", strings.ToUpper((*format)[:1])+(*format)[1:])
+		os.Exit(1)
+	}
+}
+
+// SymbolLength is a symbol length in samples, or auto to detect the symbol
+// length which receives the most packets.
+type SymbolLength struct {
+	Length int
+	Auto   bool
 }
 
-// JSON, XML and GOB all implement this interface so we can simplify log
-// output formatting.
-type Encoder interface {
-	Encode(interface{}) error
+func (sl SymbolLength) String() string {
+	if sl.Auto {
+		return "auto"
+	}
+	return strconv.Itoa(sl.Length)
+}
+
+func (sl *SymbolLength) Set(value string) (err error) {
+	if value == "auto" {
+		sl.Auto = true
+		return nil
+	}
+
+	sl.Auto = false
+	sl.Length, err = strconv.Atoi(value)
+	return err
+}
+
+// TagMap is a repeatable flag of static message tags of the form key=value.
+type TagMap parse.Tags
+
+func (m TagMap) String() string {
+	var pairs []string
+	for _, key := range parse.Tags(m).Keys() {
+		pairs = append(pairs, key+"="+m[key])
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (m TagMap) Set(value string) error {
+	pair := strings.SplitN(value, "=", 2)
+	if len(pair) != 2 || pair[1] == "" {
+		return fmt.Errorf("tag must be of the form key=value: %q", value)
+	}
+	if err := parse.CheckTagName(pair[0]); err != nil {
+		return err
+	}
+
+	m[pair[0]] = pair[1]
+	return nil
 }
 
 type UintMap map[uint]bool
@@ -169,3 +612,108 @@ func (m UintMap) Set(value string) error {
 
 	return nil
 }
+
+// UintRange is an inclusive range of values.
+type UintRange struct {
+	Lower, Upper uint
+}
+
+// UintRanges is a sorted list of disjoint inclusive ranges. Ranges are kept
+// as bounds rather than expanded, so a range as large as 0-4294967295 costs
+// no more than a single value.
+type UintRanges []UintRange
+
+// Contains reports whether n is within any of the ranges.
+func (r UintRanges) Contains(n uint) bool {
+	idx := sort.Search(len(r), func(idx int) bool { return r[idx].Upper >= n })
+	return idx < len(r) && r[idx].Lower <= n
+}
+
+// Sorts the ranges and merges any which overlap or are adjacent.
+func (r *UintRanges) merge() {
+	sort.Slice(*r, func(i, j int) bool { return (*r)[i].Lower < (*r)[j].Lower })
+
+	var merged UintRanges
+	for _, rng := range *r {
+		if last := len(merged) - 1; last >= 0 && rng.Lower <= merged[last].Upper+1 {
+			if rng.Upper > merged[last].Upper {
+				merged[last].Upper = rng.Upper
+			}
+			continue
+		}
+		merged = append(merged, rng)
+	}
+	*r = merged
+}
+
+// Reads a list of values from the given file, one per line. Lines may be a
+// single value or an inclusive range of the form lower-upper. Blank lines and
+// lines beginning with # are ignored.
+func (r *UintRanges) ReadFile(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		bounds := strings.SplitN(line, "-", 2)
+
+		lower, err := strconv.ParseUint(strings.TrimSpace(bounds[0]), 10, 32)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s", filename, lineNum, err)
+		}
+
+		upper := lower
+		if len(bounds) == 2 {
+			upper, err = strconv.ParseUint(strings.TrimSpace(bounds[1]), 10, 32)
+			if err != nil {
+				return fmt.Errorf("%s:%d: %s", filename, lineNum, err)
+			}
+			if upper < lower {
+				return fmt.Errorf("%s:%d: invalid range %q", filename, lineNum, line)
+			}
+		}
+
+		*r = append(*r, UintRange{uint(lower), uint(upper)})
+	}
+	r.merge()
+
+	return scanner.Err()
+}
+
+// Flags with names containing any of these have their values redacted by
+// LogFlags.
+var redactedFlagNames = []string{"password", "token", "key"}
+
+// LogFlags logs the name, value and source of every flag: cli if given on
+// the command line, otherwise default.
+func LogFlags() {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	flag.VisitAll(func(f *flag.Flag) {
+		source := "default"
+		if set[f.Name] {
+			source = "cli"
+		}
+
+		value := f.Value.String()
+		for _, name := range redactedFlagNames {
+			if strings.Contains(strings.ToLower(f.Name), name) {
+				value = "[redacted]"
+				break
+			}
+		}
+
+		log.Printf("Flag %s=%q (%s)\n", f.Name, value, source)
+	})
+}
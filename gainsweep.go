@@ -0,0 +1,150 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2014 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/bemasher/rtlamr/decode"
+	"github.com/bemasher/rtlamr/parse"
+	"github.com/bemasher/rtlamr/session"
+)
+
+// Blocks received at each gain step by -gain-sweep.
+const GainSweepBlocks = 1000
+
+// Gain steps in dB of tuners which report them by index, from librtlsdr.
+// Tuners are identified by the type given in rtl_tcp's dongle info.
+var tunerGains = map[uint32][]float64{
+	// E4000
+	1: {-1.0, 1.5, 4.0, 6.5, 9.0, 11.5, 14.0, 16.5, 19.0, 21.5, 24.0, 29.0, 34.0, 42.0},
+	// FC0012
+	2: {-9.9, -4.0, 7.1, 17.9, 19.2},
+	// FC0013
+	3: {-9.9, -7.3, -6.5, -6.3, -6.0, -5.8, -5.4, 5.8, 6.1, 6.3, 6.5, 6.7, 6.8, 7.0, 7.1, 17.9, 18.1, 18.2, 18.4, 18.6, 18.8, 19.1, 19.7},
+	// R820T
+	5: r82xxGains,
+	// R828D
+	6: r82xxGains,
+}
+
+var r82xxGains = []float64{
+	0.0, 0.9, 1.4, 2.7, 3.7, 7.7, 8.7, 12.5, 14.4, 15.7, 16.6, 19.7, 20.7, 22.9,
+	25.4, 28.0, 29.7, 32.8, 33.8, 36.4, 37.2, 38.6, 40.2, 42.1, 43.4, 43.9, 44.5,
+	48.0, 49.6,
+}
+
+// Returns the gain in dB of the given step as a string, or "-" if the
+// tuner's gains aren't known.
+func gainDB(tuner, step uint32) string {
+	gains := tunerGains[tuner]
+	if int(step) >= len(gains) {
+		return "-"
+	}
+	return fmt.Sprintf("%0.1f", gains[step])
+}
+
+// The packets decoded and average RMS power in dBFS at a gain step.
+type gainStepResult struct {
+	packets uint32
+	power   float64
+}
+
+// Returns the gain step which decoded the most packets. Ties go to the step
+// with the lowest power, the least gain which does as well, leaving the most
+// headroom before clipping. Returns false if no step decoded any packets.
+func bestGainStep(results []gainStepResult) (best uint32, ok bool) {
+	for step, result := range results {
+		if result.packets == 0 {
+			continue
+		}
+
+		b := results[best]
+		if !ok || result.packets > b.packets || (result.packets == b.packets && result.power < b.power) {
+			best, ok = uint32(step), true
+		}
+	}
+	return
+}
+
+// gainSweep receives GainSweepBlocks blocks at each gain step reported by
+// rtl_tcp, prints the number of valid packets decoded and signal power of
+// each, then sets the gain to the step which decoded the most packets. If no
+// step decodes any packets, automatic gain is used instead.
+func (rcvr *Receiver) gainSweep() {
+	count := rcvr.SDR.Info.GainCount
+	if count == 0 {
+		log.Fatal("rtl_tcp reported no gain settings to sweep")
+	}
+
+	block := make([]byte, rcvr.d.Cfg.BlockSize2)
+	raw := block
+	if *downsample > 1 {
+		raw = make([]byte, len(block)**downsample)
+	}
+
+	rcvr.SetGainMode(true)
+
+	fmt.Println("gain_step, gain_dB, packets_decoded, rms_power_dBFS")
+
+	results := make([]gainStepResult, count)
+	for step := uint32(0); step < count; step++ {
+		rcvr.SetGainByIndex(step)
+
+		var packets uint32
+		var power float64
+		for idx := 0; idx < GainSweepBlocks; idx++ {
+			if _, err := io.ReadFull(rcvr, raw); err != nil {
+				log.Fatal("Error reading samples: ", err)
+			}
+			if notch != nil {
+				notch.Execute(raw)
+			}
+			if *downsample > 1 {
+				decode.Decimate(raw, block, *downsample)
+			}
+
+			power += RMSPower(block)
+			for _, pkt := range rcvr.d.Decode(block) {
+				if _, err := rcvr.p.Parse(parse.NewDataFromBytes(pkt)); err == nil {
+					packets++
+				}
+			}
+		}
+
+		results[step] = gainStepResult{packets, power / GainSweepBlocks}
+		fmt.Printf("%d, %s, %d, %0.1f\n", step, gainDB(uint32(rcvr.SDR.Info.Tuner), step), packets, results[step].power)
+	}
+
+	best, ok := bestGainStep(results)
+	if !ok {
+		log.Println("Gain sweep: no packets decoded at any gain step, using automatic gain")
+		rcvr.SetGainMode(false)
+		recordCommand(session.SetGainMode, 0)
+		return
+	}
+
+	rcvr.SetGainByIndex(best)
+	recordCommand(session.SetGainMode, 1)
+	recordCommand(session.SetGainByIndex, best)
+
+	if !*quiet {
+		log.Printf("Gain sweep: step %d decoded %d packets\n", best, results[best].packets)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/bemasher/rtlamr/decode"
+	"github.com/bemasher/rtlamr/internal/testutil"
+	"github.com/bemasher/rtlamr/scm"
+)
+
+func TestBestGainStep(t *testing.T) {
+	testCases := []struct {
+		name    string
+		results []gainStepResult
+		best    uint32
+		ok      bool
+	}{
+		{"most packets", []gainStepResult{{1, -30}, {5, -20}, {3, -10}}, 1, true},
+		{"tie by power", []gainStepResult{{0, -40}, {5, -20}, {5, -25}, {2, -10}}, 2, true},
+		{"tie at equal power", []gainStepResult{{5, -20}, {5, -20}}, 0, true},
+		{"nothing decoded", []gainStepResult{{0, -40}, {0, -30}}, 0, false},
+	}
+
+	for _, tc := range testCases {
+		best, ok := bestGainStep(tc.results)
+		if best != tc.best || ok != tc.ok {
+			t.Errorf("%s: expected step %d and %v, got %d and %v", tc.name, tc.best, tc.ok, best, ok)
+		}
+	}
+}
+
+// Returns samples of noise with the given standard deviation.
+func noise(samples int, level float64, rng *rand.Rand) []byte {
+	iq := make([]byte, samples<<1)
+	for idx := range iq {
+		iq[idx] = testutil.Clip(127.4 + rng.NormFloat64()*level)
+	}
+	return iq
+}
+
+func TestGainSweep(t *testing.T) {
+	cfg := scm.NewPacketConfig(73)
+	rng := rand.New(rand.NewSource(1))
+	stepLen := GainSweepBlocks * cfg.BlockSize2
+
+	var packets []byte
+	for id := uint32(1); id <= 10; id++ {
+		packets = append(packets, testutil.Synthesize(cfg, testutil.NewSCMPacket(id, 1000), cfg.BlockSize2, rng)...)
+	}
+
+	// Steps 1 and 2 decode the same packets, step 2 with less noise.
+	steps := [][]byte{
+		noise(stepLen>>1, testutil.NoiseLevel, rng),
+		append(append([]byte(nil), packets...), noise((stepLen-len(packets))>>1, 40, rng)...),
+		append(append([]byte(nil), packets...), noise((stepLen-len(packets))>>1, testutil.NoiseLevel, rng)...),
+		noise(stepLen>>1, testutil.NoiseLevel, rng),
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		info := []byte{'R', 'T', 'L', '0', 0, 0, 0, 5, 0, 0, 0, byte(len(steps))}
+		if _, err := conn.Write(info); err != nil {
+			return
+		}
+		for _, step := range steps {
+			if _, err := conn.Write(step); err != nil {
+				return
+			}
+		}
+	}()
+
+	var rcvr Receiver
+	rcvr.d = decode.NewDecoder(cfg)
+	rcvr.p = scm.NewParser()
+
+	if err := rcvr.Connect(l.Addr().(*net.TCPAddr)); err != nil {
+		t.Fatal(err)
+	}
+	defer rcvr.Close()
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	rcvr.gainSweep()
+
+	if !strings.Contains(buf.String(), "Gain sweep: step 2 decoded") {
+		t.Errorf("expected step 2 to be chosen, got %q", buf.String())
+	}
+}
@@ -0,0 +1,52 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2014 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"sync"
+)
+
+// GzipWriter compresses writes to an underlying writer. Writes are
+// serialized so concurrent writers may share it.
+type GzipWriter struct {
+	mu sync.Mutex
+	gz *gzip.Writer
+}
+
+func NewGzipWriter(w io.Writer, level int) (*GzipWriter, error) {
+	gz, err := gzip.NewWriterLevel(w, level)
+	if err != nil {
+		return nil, err
+	}
+	return &GzipWriter{gz: gz}, nil
+}
+
+func (gw *GzipWriter) Write(p []byte) (int, error) {
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+	return gw.gz.Write(p)
+}
+
+// Close writes any buffered data and the gzip footer, it doesn't close the
+// underlying writer.
+func (gw *GzipWriter) Close() error {
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+	return gw.gz.Close()
+}
@@ -0,0 +1,183 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2014 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/bemasher/rtlamr/parse"
+)
+
+// MessageHandler filters parsed messages, fills in the fields given by
+// flags and writes them to every output. Run and -replay share it so both
+// apply the same filters in the same order.
+type MessageHandler struct {
+	// Messages written.
+	received int
+
+	// Messages written since output was last flushed.
+	buffered int
+
+	// Messages discarded by -strip-zero-consumption.
+	stripped int
+
+	// Messages discarded by -strict-meter-type, by type code.
+	unknownTypes map[uint8]int
+
+	// Messages dropped by the output rate limit.
+	dropped DropCounter
+}
+
+func NewMessageHandler() *MessageHandler {
+	return &MessageHandler{unknownTypes: make(map[uint8]int)}
+}
+
+// Handle filters msg and writes it if it passes, reporting whether it was
+// written. The caller sets Time, Offset, Length and Message, and RawPacket
+// and CRCValid if known. Time filters compare against msg.Time. Tags,
+// warnings, raw packets and checksum validity follow the current flags.
+func (h *MessageHandler) Handle(msg parse.LogMessage) bool {
+	if !matchesMeterFilter(msg.Message) {
+		return false
+	}
+
+	if *strictMeterType {
+		if _, ok := parse.MeterTypeName[msg.MeterType()]; !ok {
+			if h.unknownTypes[msg.MeterType()] == 0 {
+				log.Printf("Discarding messages with unknown meter type %d\n", msg.MeterType())
+			}
+			h.unknownTypes[msg.MeterType()]++
+			return false
+		}
+	}
+
+	if *stripZeroConsumption {
+		if c, ok := consumption(msg.Message); ok && c == 0 {
+			h.stripped++
+			return false
+		}
+	}
+
+	if (!filterAfter.IsZero() && msg.Time.Before(filterAfter)) ||
+		(!filterBefore.IsZero() && !msg.Time.Before(filterBefore)) {
+		return false
+	}
+
+	// Readings are recorded only once written, or skipped as a meter's
+	// first, so deltas of dropped messages are carried by the next one.
+	reading := msg.Message
+	if deltaTracker != nil {
+		var ok bool
+		if msg.Message, ok = deltaTracker.Apply(reading); !ok {
+			deltaTracker.Record(reading)
+			return false
+		}
+	}
+
+	if discovered != nil && discovered[msg.MeterID()] {
+		return false
+	}
+
+	if len(tags) > 0 {
+		if msg.Tags == nil {
+			msg.Tags = parse.Tags(tags)
+		} else {
+			for key, value := range tags {
+				msg.Tags[key] = value
+			}
+		}
+	}
+	if !*includeRaw {
+		msg.RawPacket = ""
+	}
+	msg.Warnings = nil
+	if v, ok := msg.Message.(parse.Validator); ok && *validate {
+		msg.Warnings = v.Validate()
+	}
+	if !*noCRCFilter {
+		msg.CRCValid = nil
+	}
+
+	if outputLimiter != nil && !outputLimiter.Allow() {
+		h.dropped.Add()
+		return false
+	}
+
+	h.received++
+	if deltaTracker != nil {
+		deltaTracker.Record(reading)
+	}
+
+	if discovered != nil {
+		_, err := fmt.Fprintf(output, "%d,%d,%s\n", msg.MeterID(), msg.MeterType(), msg.Time.Format(parse.TimeFormat))
+		if err != nil {
+			log.Fatal("Error writing discovered meter: ", err)
+		}
+		flushOutput()
+
+		// Only once written, a meter whose first message is rate limited is
+		// reported by a later one.
+		discovered[msg.MeterID()] = true
+		return true
+	}
+
+	writeSinks(msg)
+
+	if splitWriter != nil {
+		if err := splitWriter.Write(msg); err != nil {
+			log.Fatal("Error writing split file: ", err)
+		}
+		return true
+	}
+
+	if err := WriteMessage(output, encoder, msg); err != nil {
+		log.Fatal("Error encoding message: ", err)
+	}
+
+	h.buffered++
+	if h.buffered >= *outputBuffer {
+		h.Flush()
+	}
+	return true
+}
+
+// Done reports whether -single or -count has been satisfied.
+func (h *MessageHandler) Done() bool {
+	return (*single && h.received > 0) || (*count != 0 && h.received >= *count)
+}
+
+// Flush writes any buffered output.
+func (h *MessageHandler) Flush() {
+	flushOutput()
+	h.buffered = 0
+}
+
+// Close reports drops not yet logged, closes split files and sinks, and
+// writes any buffered output.
+func (h *MessageHandler) Close() {
+	h.dropped.Flush()
+	if splitWriter != nil {
+		splitWriter.Close()
+	}
+	for _, sink := range sinks {
+		if err := sink.Close(); err != nil {
+			log.Println("Error closing output", sink, err)
+		}
+	}
+	h.Flush()
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/bemasher/rtlamr/parse"
+	"github.com/bemasher/rtlamr/scm"
+)
+
+func TestHandlerDiscover(t *testing.T) {
+	var buf bytes.Buffer
+	output, discovered = &buf, make(map[uint32]bool)
+	defer func() { output, discovered, outputLimiter = nil, nil, nil }()
+
+	received := time.Date(2017, 7, 14, 2, 40, 0, 0, time.UTC)
+	msg := func(id uint32) parse.LogMessage {
+		return parse.LogMessage{Time: received, Message: scm.SCM{ID: id, Type: 7}}
+	}
+
+	// Meter 2's first message is dropped by the rate limit, so it's
+	// reported by its second.
+	outputLimiter = &TokenBucket{burst: 1}
+	h := NewMessageHandler()
+	for _, tc := range []struct {
+		msg     parse.LogMessage
+		allow   bool
+		written bool
+	}{
+		{msg(1), true, true},
+		{msg(1), true, false},
+		{msg(2), false, false},
+		{msg(2), true, true},
+		{msg(2), true, false},
+	} {
+		if tc.allow {
+			outputLimiter.tokens = 1
+		} else {
+			outputLimiter.tokens = 0
+		}
+		outputLimiter.last = time.Now()
+
+		if written := h.Handle(tc.msg); written != tc.written {
+			t.Errorf("meter %d: expected written %v, got %v", tc.msg.MeterID(), tc.written, written)
+		}
+	}
+
+	expected := "1,7,2017-07-14T02:40:00.000\n2,7,2017-07-14T02:40:00.000\n"
+	if buf.String() != expected {
+		t.Errorf("expected %q, got %q", expected, buf.String())
+	}
+	if h.received != 2 {
+		t.Errorf("expected 2 received, got %d", h.received)
+	}
+}
+
+func TestHandlerDelta(t *testing.T) {
+	var buf bytes.Buffer
+	output, encoder = &buf, NewEncoder("json", &buf)
+	deltaTracker = NewDeltaTracker(false)
+	defer func() { output, encoder, deltaTracker, outputLimiter = nil, nil, nil, nil }()
+
+	// The rate limited reading of 1010 isn't recorded, so the next delta
+	// covers it.
+	outputLimiter = &TokenBucket{burst: 1}
+	h := NewMessageHandler()
+	for _, tc := range []struct {
+		consumption uint32
+		allow       bool
+	}{
+		{1000, true},
+		{1010, false},
+		{1025, true},
+	} {
+		if tc.allow {
+			outputLimiter.tokens = 1
+		} else {
+			outputLimiter.tokens = 0
+		}
+		outputLimiter.last = time.Now()
+
+		h.Handle(parse.LogMessage{Message: scm.SCM{ID: 1, Type: 7, Consumption: tc.consumption}})
+	}
+
+	var deltas []uint32
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var rm replayMessage
+		if err := dec.Decode(&rm); err != nil {
+			t.Fatal(err)
+		}
+		var msg scm.SCM
+		if err := json.Unmarshal(rm.Message, &msg); err != nil {
+			t.Fatal(err)
+		}
+		deltas = append(deltas, msg.Consumption)
+	}
+
+	if len(deltas) != 2 || deltas[0] != 0 || deltas[1] != 25 {
+		t.Errorf("expected deltas [0 25], got %v", deltas)
+	}
+}
@@ -0,0 +1,85 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2014 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+// Histogram counts occurrences of each raw 8-bit sample value.
+type Histogram [256]uint64
+
+func (h *Histogram) Add(samples []byte) {
+	for _, v := range samples {
+		h[v]++
+	}
+}
+
+// WriteCSV writes the histogram as amplitude_value,count rows preceded by
+// comments summarizing the samples: min, max, mean and standard deviation.
+func (h *Histogram) WriteCSV(w io.Writer) error {
+	var n, sum, sumSq float64
+	min, max := -1, -1
+	for v, count := range h {
+		if count == 0 {
+			continue
+		}
+		if min < 0 {
+			min = v
+		}
+		max = v
+
+		n += float64(count)
+		sum += float64(count) * float64(v)
+		sumSq += float64(count) * float64(v) * float64(v)
+	}
+
+	bw := bufio.NewWriter(w)
+	if n > 0 {
+		mean := sum / n
+		fmt.Fprintf(bw, "# samples: %0.0f\n", n)
+		fmt.Fprintf(bw, "# min: %d\n# max: %d\n", min, max)
+		fmt.Fprintf(bw, "# mean: %0.3f\n", mean)
+		fmt.Fprintf(bw, "# stddev: %0.3f\n", math.Sqrt(sumSq/n-mean*mean))
+	}
+
+	fmt.Fprintln(bw, "amplitude_value,count")
+	for v, count := range h {
+		fmt.Fprintf(bw, "%d,%d\n", v, count)
+	}
+
+	return bw.Flush()
+}
+
+// WriteFile writes the histogram to the named file, replacing it.
+func (h *Histogram) WriteFile(filename string) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+
+	if err := h.WriteCSV(f); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
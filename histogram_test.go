@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestHistogramWriteCSV(t *testing.T) {
+	var h Histogram
+	h.Add([]byte{126, 128, 128, 130})
+
+	var buf bytes.Buffer
+	if err := h.WriteCSV(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+
+	header := []string{
+		"# samples: 4",
+		"# min: 126",
+		"# max: 130",
+		"# mean: 128.000",
+		"# stddev: 1.414",
+		"amplitude_value,count",
+	}
+	for idx, expected := range header {
+		if lines[idx] != expected {
+			t.Errorf("line %d: expected %q, got %q", idx, expected, lines[idx])
+		}
+	}
+
+	rows := lines[len(header):]
+	if len(rows) != 256 {
+		t.Fatalf("expected 256 rows, got %d", len(rows))
+	}
+	if rows[128] != "128,2" || rows[0] != "0,0" {
+		t.Errorf("unexpected rows: %q, %q", rows[0], rows[128])
+	}
+}
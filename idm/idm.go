@@ -17,19 +17,38 @@
 package idm
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/bemasher/rtlamr/crc"
 	"github.com/bemasher/rtlamr/decode"
 	"github.com/bemasher/rtlamr/parse"
 )
 
+func init() {
+	parse.RegisterBinaryMessage(BinaryType, UnmarshalBinary)
+}
+
+// Symbols per second.
+const DataRate = 32768
+
+// NewPacketConfig returns the radio configuration for IDM packets.
+// Symbol length is the number of samples per symbol and determines the sample
+// rate, DataRate times the symbol length. Lengths of 7-9 and 28-97 give
+// sample rates the dongle supports, see decode.CheckSymbolLength, others
+// suit samples decimated from a supported rate. Panics if the symbol length
+// isn't positive.
 func NewPacketConfig(symbolLength int) (cfg decode.PacketConfig) {
-	cfg.DataRate = 32768
+	cfg.DataRate = DataRate
+
+	if symbolLength <= 0 {
+		panic(fmt.Sprintf("idm.NewPacketConfig: invalid symbol length %d", symbolLength))
+	}
 
 	cfg.SymbolLength = symbolLength
 	cfg.SymbolLength2 = cfg.SymbolLength << 1
@@ -51,6 +70,35 @@ func NewPacketConfig(symbolLength int) (cfg decode.PacketConfig) {
 	return
 }
 
+// Decoder combines a decoder and parser, decoding IDM messages directly
+// from sample blocks.
+type Decoder struct {
+	decode.Decoder
+	Parser
+}
+
+// Create a new decoder for IDM messages with the given symbol length.
+func NewDecoder(symbolLength int, opts ...decode.Option) (d Decoder) {
+	d.Decoder = decode.NewDecoder(NewPacketConfig(symbolLength), opts...)
+	d.Parser = NewParser()
+	return
+}
+
+// Decode returns the valid IDM messages found in the given sample block.
+// Packets which fail to parse are counted as checksum failures in the
+// decoder's stats.
+func (d Decoder) Decode(block []byte) (msgs []IDM) {
+	for _, pkt := range d.Decoder.Decode(block) {
+		msg, err := d.Parse(parse.NewDataFromBytes(pkt))
+		if err != nil {
+			d.AddCRCFailure()
+			continue
+		}
+		msgs = append(msgs, msg.(IDM))
+	}
+	return
+}
+
 type Parser struct {
 	crc.CRC
 }
@@ -106,6 +154,43 @@ func (idm IDM) MeterType() uint8 {
 	return idm.ERTType
 }
 
+// Checksum returns the packet CRC as received, for parity with the SCM
+// Checksum field.
+func (idm IDM) Checksum() uint16 {
+	return idm.PacketCRC
+}
+
+// Duration of each differential consumption interval by ERT type.
+var intervalDurations = map[uint8]time.Duration{
+	7: 5 * time.Minute,
+	8: 15 * time.Minute,
+}
+
+// IntervalDuration returns the duration of each differential consumption
+// interval, determined by the ERT type. Returns 0 for types with an unknown
+// interval duration.
+func (idm IDM) IntervalDuration() time.Duration {
+	return intervalDurations[idm.ERTType]
+}
+
+// Clone returns a copy of the message which doesn't share tamper counters or
+// power outage flags with the packet it was parsed from.
+func (idm IDM) Clone() parse.Message {
+	idm.TamperCounters = append([]byte(nil), idm.TamperCounters...)
+	idm.PowerOutageFlags = append([]byte(nil), idm.PowerOutageFlags...)
+	return idm
+}
+
+// ExtraFields returns the consumption counters and transmit time offset.
+func (idm IDM) ExtraFields() map[string]interface{} {
+	return map[string]interface{}{
+		"last_consumption_count":     idm.LastConsumptionCount,
+		"consumption_interval_count": idm.ConsumptionIntervalCount,
+		"asynchronous_counters":      idm.AsynchronousCounters,
+		"transmit_time_offset":       idm.TransmitTimeOffset,
+	}
+}
+
 func (idm IDM) String() string {
 	var fields []string
 
@@ -152,11 +237,31 @@ func (idm IDM) Record() (r []string) {
 	return
 }
 
+// Type returns "idm".
+func (p Parser) Type() string {
+	return "idm"
+}
+
 func (p Parser) Parse(data parse.Data) (msg parse.Message, err error) {
+	if l := len(data.Bytes); l < 92 {
+		err = fmt.Errorf("packet too short: %d", l)
+		return
+	}
+	if !parse.CheckCRC(data, p.CRC, 4, 92) {
+		err = parse.NewCRCError(data, p.CRC, 4, 92)
+		return
+	}
+
+	return p.ParseUnchecked(data)
+}
+
+// ParseUnchecked parses a packet without verifying its checksum, fields of a
+// corrupt packet may be garbage.
+func (p Parser) ParseUnchecked(data parse.Data) (msg parse.Message, err error) {
 	var idm IDM
 
-	if residue := p.Checksum(data.Bytes[4:92]); residue != p.Residue {
-		err = fmt.Errorf("packet checksum failed: 0x%04X", residue)
+	if l := len(data.Bytes); l < 92 {
+		err = fmt.Errorf("packet too short: %d", l)
 		return
 	}
 
@@ -165,7 +270,7 @@ func (p Parser) Parse(data parse.Data) (msg parse.Message, err error) {
 	idm.PacketLength = data.Bytes[5]
 	idm.HammingCode = data.Bytes[6]
 	idm.ApplicationVersion = data.Bytes[7]
-	idm.ERTType = data.Bytes[8] & 0x0F
+	idm.ERTType = uint8(data.Extract(68, 4))
 	idm.ERTSerialNumber = binary.BigEndian.Uint32(data.Bytes[9:13])
 	idm.ConsumptionIntervalCount = data.Bytes[13]
 	idm.ModuleProgrammingState = data.Bytes[14]
@@ -176,8 +281,7 @@ func (p Parser) Parse(data parse.Data) (msg parse.Message, err error) {
 
 	offset := 264
 	for idx := range idm.DifferentialConsumptionIntervals {
-		interval, _ := strconv.ParseUint(data.Bits[offset:offset+9], 2, 9)
-		idm.DifferentialConsumptionIntervals[idx] = uint16(interval)
+		idm.DifferentialConsumptionIntervals[idx] = uint16(data.Extract(offset, 9))
 		offset += 9
 	}
 
@@ -191,3 +295,84 @@ func (p Parser) Parse(data parse.Data) (msg parse.Message, err error) {
 
 	return idm, nil
 }
+
+// Identifies IDM messages in binary encoded log messages.
+const BinaryType = 0x02
+
+type idmBinary struct {
+	Preamble                         uint32
+	PacketTypeID                     uint8
+	PacketLength                     uint8
+	HammingCode                      uint8
+	ApplicationVersion               uint8
+	ERTType                          uint8
+	ERTSerialNumber                  uint32
+	ConsumptionIntervalCount         uint8
+	ModuleProgrammingState           uint8
+	TamperCounters                   [6]byte
+	AsynchronousCounters             uint16
+	PowerOutageFlags                 [6]byte
+	LastConsumptionCount             uint32
+	DifferentialConsumptionIntervals Interval
+	TransmitTimeOffset               uint16
+	SerialNumberCRC                  uint16
+	PacketCRC                        uint16
+}
+
+func (idm IDM) BinaryType() uint8 {
+	return BinaryType
+}
+
+func (idm IDM) MarshalBinary() ([]byte, error) {
+	b := idmBinary{
+		Preamble:                         idm.Preamble,
+		PacketTypeID:                     idm.PacketTypeID,
+		PacketLength:                     idm.PacketLength,
+		HammingCode:                      idm.HammingCode,
+		ApplicationVersion:               idm.ApplicationVersion,
+		ERTType:                          idm.ERTType,
+		ERTSerialNumber:                  idm.ERTSerialNumber,
+		ConsumptionIntervalCount:         idm.ConsumptionIntervalCount,
+		ModuleProgrammingState:           idm.ModuleProgrammingState,
+		AsynchronousCounters:             idm.AsynchronousCounters,
+		LastConsumptionCount:             idm.LastConsumptionCount,
+		DifferentialConsumptionIntervals: idm.DifferentialConsumptionIntervals,
+		TransmitTimeOffset:               idm.TransmitTimeOffset,
+		SerialNumberCRC:                  idm.SerialNumberCRC,
+		PacketCRC:                        idm.PacketCRC,
+	}
+	copy(b.TamperCounters[:], idm.TamperCounters)
+	copy(b.PowerOutageFlags[:], idm.PowerOutageFlags)
+
+	var buf bytes.Buffer
+	err := binary.Write(&buf, binary.BigEndian, b)
+	return buf.Bytes(), err
+}
+
+// Decodes an IDM message encoded by MarshalBinary.
+func UnmarshalBinary(data []byte) (msg parse.Message, err error) {
+	var b idmBinary
+	if err = binary.Read(bytes.NewReader(data), binary.BigEndian, &b); err != nil {
+		return
+	}
+
+	return IDM{
+		Preamble:                         b.Preamble,
+		PacketTypeID:                     b.PacketTypeID,
+		PacketLength:                     b.PacketLength,
+		HammingCode:                      b.HammingCode,
+		ApplicationVersion:               b.ApplicationVersion,
+		ERTType:                          b.ERTType,
+		ERTSerialNumber:                  b.ERTSerialNumber,
+		ConsumptionIntervalCount:         b.ConsumptionIntervalCount,
+		ModuleProgrammingState:           b.ModuleProgrammingState,
+		TamperCounters:                   b.TamperCounters[:],
+		AsynchronousCounters:             b.AsynchronousCounters,
+		PowerOutageFlags:                 b.PowerOutageFlags[:],
+		LastConsumptionCount:             b.LastConsumptionCount,
+		DifferentialConsumptionIntervals: b.DifferentialConsumptionIntervals,
+		TransmitTimeOffset:               b.TransmitTimeOffset,
+		SerialNumberCRC:                  b.SerialNumberCRC,
+		PacketCRC:                        b.PacketCRC,
+	}, nil
+}
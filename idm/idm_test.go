@@ -0,0 +1,222 @@
+package idm
+
+import (
+	"encoding/json"
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bemasher/rtlamr/internal/testutil"
+	"github.com/bemasher/rtlamr/parse"
+)
+
+func TestIDMParseIntegration(t *testing.T) {
+	expected := []struct {
+		ERTType              uint8
+		ERTSerialNumber      uint32
+		LastConsumptionCount uint32
+		FirstInterval        uint16
+		LastInterval         uint16
+		TransmitTimeOffset   uint16
+	}{
+		{7, 40000004, 2500000, 0, 322, 1500},
+		{8, 50000005, 123456, 511, 465, 42},
+	}
+
+	pkts := testutil.ReadPackets(t, "testdata/packets.txt")
+	if len(pkts) != len(expected) {
+		t.Fatalf("expected %d packets, got %d", len(expected), len(pkts))
+	}
+
+	p := NewParser()
+	for idx, pkt := range pkts {
+		msg, err := p.Parse(pkt)
+		if err != nil {
+			t.Errorf("packet %d: %s", idx, err)
+			continue
+		}
+
+		idm := msg.(IDM)
+		exp := expected[idx]
+		intervals := idm.DifferentialConsumptionIntervals
+
+		if idm.ERTType != exp.ERTType {
+			t.Errorf("packet %d: expected ERTType %d, got %d", idx, exp.ERTType, idm.ERTType)
+		}
+		if idm.ERTSerialNumber != exp.ERTSerialNumber {
+			t.Errorf("packet %d: expected ERTSerialNumber %d, got %d", idx, exp.ERTSerialNumber, idm.ERTSerialNumber)
+		}
+		if idm.LastConsumptionCount != exp.LastConsumptionCount {
+			t.Errorf("packet %d: expected LastConsumptionCount %d, got %d", idx, exp.LastConsumptionCount, idm.LastConsumptionCount)
+		}
+		if intervals[0] != exp.FirstInterval || intervals[len(intervals)-1] != exp.LastInterval {
+			t.Errorf("packet %d: expected intervals %d...%d, got %d...%d", idx,
+				exp.FirstInterval, exp.LastInterval, intervals[0], intervals[len(intervals)-1],
+			)
+		}
+		if idm.TransmitTimeOffset != exp.TransmitTimeOffset {
+			t.Errorf("packet %d: expected TransmitTimeOffset %d, got %d", idx, exp.TransmitTimeOffset, idm.TransmitTimeOffset)
+		}
+		if crc := uint16(pkt.Bytes[90])<<8 | uint16(pkt.Bytes[91]); idm.Checksum() != crc {
+			t.Errorf("packet %d: expected Checksum 0x%04X, got 0x%04X", idx, crc, idm.Checksum())
+		}
+	}
+}
+
+func TestIntervalDuration(t *testing.T) {
+	tests := []struct {
+		ertType  uint8
+		expected time.Duration
+	}{
+		{7, 5 * time.Minute},
+		{8, 15 * time.Minute},
+		{0, 0},
+		{12, 0},
+	}
+
+	for _, test := range tests {
+		idm := IDM{ERTType: test.ertType}
+		if d := idm.IntervalDuration(); d != test.expected {
+			t.Errorf("type %d: expected %s, got %s", test.ertType, test.expected, d)
+		}
+	}
+}
+
+func TestDecoder(t *testing.T) {
+	pkts := testutil.ReadPackets(t, "testdata/packets.txt")
+	d := NewDecoder(72)
+	rng := rand.New(rand.NewSource(1))
+
+	// Every packet, then the first with a corrupted checksum.
+	var iq []byte
+	for _, pkt := range pkts {
+		iq = append(iq, testutil.Synthesize(d.Cfg, pkt.Bytes, d.Cfg.BlockSize2, rng)...)
+	}
+	corrupt := append([]byte(nil), pkts[0].Bytes...)
+	corrupt[len(corrupt)-1] ^= 0xFF
+	iq = append(iq, testutil.Synthesize(d.Cfg, corrupt, d.Cfg.BlockSize2, rng)...)
+
+	// Neighbouring offsets may decode the same packet more than once.
+	found := map[uint32]bool{}
+	blockSize := d.Cfg.BlockSize2
+	for idx := 0; idx+blockSize <= len(iq); idx += blockSize {
+		for _, msg := range d.Decode(iq[idx : idx+blockSize]) {
+			found[msg.MeterID()] = true
+		}
+	}
+
+	p := NewParser()
+	for idx, pkt := range pkts {
+		msg, err := p.Parse(pkt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !found[msg.MeterID()] {
+			t.Errorf("packet %d: meter %d not decoded", idx, msg.MeterID())
+		}
+	}
+	if len(found) != len(pkts) {
+		t.Errorf("expected %d meters, got %d", len(pkts), len(found))
+	}
+
+	if d.Stats().CRCFailures == 0 {
+		t.Error("expected the corrupted packet to be counted as a checksum failure")
+	}
+}
+
+func TestIDMBinaryRoundTrip(t *testing.T) {
+	msg, err := NewParser().Parse(testutil.ReadPackets(t, "testdata/packets.txt")[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	valid, invalid := true, false
+	for _, expected := range []parse.LogMessage{
+		{
+			Time:      time.Unix(1500000000, 123456789),
+			Offset:    4096,
+			Length:    16384,
+			Message:   msg,
+			RawPacket: "F9A5",
+			Warnings:  []string{"first warning", "second warning"},
+			CRCValid:  &valid,
+			Tags:      parse.Tags{"site": "building-A", "antenna": "roof"},
+		},
+		{Time: time.Unix(1500000000, 0), Message: msg, CRCValid: &invalid},
+		{Time: time.Unix(1500000000, 0), Message: msg},
+	} {
+		encoded, err := expected.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var decoded parse.LogMessage
+		if err := decoded.UnmarshalBinary(encoded); err != nil {
+			t.Fatal(err)
+		}
+
+		if !decoded.Time.Equal(expected.Time) {
+			t.Errorf("expected time %s, got %s", expected.Time, decoded.Time)
+		}
+		decoded.Time = expected.Time
+		if !reflect.DeepEqual(decoded, expected) {
+			t.Errorf("expected %+v, got %+v", expected, decoded)
+		}
+	}
+}
+
+func TestIDMJSONRoundTrip(t *testing.T) {
+	p := NewParser()
+
+	for _, pkt := range testutil.ReadPackets(t, "testdata/packets.txt") {
+		expected, err := p.Parse(pkt)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := json.Marshal(expected)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var msg IDM
+		if err := json.Unmarshal(data, &msg); err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(msg, expected) {
+			t.Errorf("expected %+v, got %+v from %s", expected, msg, data)
+		}
+	}
+}
+
+func TestClone(t *testing.T) {
+	p := NewParser()
+
+	pkt := testutil.ReadPackets(t, "testdata/packets.txt")[0]
+	msg, err := p.Parse(pkt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	original := parse.LogMessage{Message: msg, Warnings: []string{"warning"}}
+	clone := original.Clone()
+
+	if !reflect.DeepEqual(clone, original) {
+		t.Fatalf("expected %+v, got %+v", original, clone)
+	}
+
+	// Modifying the packet or clone doesn't affect the other.
+	for idx := range pkt.Bytes {
+		pkt.Bytes[idx] ^= 0xFF
+	}
+	clone.Warnings[0] = "modified"
+
+	if reflect.DeepEqual(clone.Message, original.Message) {
+		t.Error("clone shares memory with packet")
+	}
+	if original.Warnings[0] != "warning" {
+		t.Error("clone shares warnings with original")
+	}
+}
@@ -0,0 +1,133 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2014 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package testutil holds helpers shared by the tests of several packages:
+// reading packets from testdata and synthesizing samples of packets.
+package testutil
+
+import (
+	"bufio"
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/bemasher/rtlamr/crc"
+	"github.com/bemasher/rtlamr/decode"
+	"github.com/bemasher/rtlamr/parse"
+)
+
+const (
+	// Amplitude of the on half of synthesized symbols.
+	Amplitude = 64.0
+
+	// Standard deviation of the noise added to each inphase and quadrature
+	// component.
+	NoiseLevel = 4.0
+)
+
+// Reads hex encoded packets from the given file, one per line. Blank lines
+// and lines beginning with # are ignored.
+func ReadPackets(t testing.TB, filename string) (pkts []parse.Data) {
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		data, err := parse.NewDataFromHex(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pkts = append(pkts, data)
+	}
+
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	return
+}
+
+// Builds a valid SCM packet with the given id and consumption.
+func NewSCMPacket(id, consumption uint32) (pkt []byte) {
+	pkt = make([]byte, 12)
+
+	// Preamble, ert id msb's, tamper, type and consumption.
+	bits := uint64(0x1F2A60) << 43
+	bits |= uint64(id>>24&0x03) << 41
+	bits |= uint64(7) << 34
+	bits |= uint64(consumption&0xFFFFFF) << 8
+	bits |= uint64(id & 0xFFFFFF >> 16)
+	binary.BigEndian.PutUint64(pkt[0:8], bits)
+	binary.BigEndian.PutUint16(pkt[8:10], uint16(id))
+
+	bch := crc.NewCRC("BCH", 0, 0x6F63, 0)
+	binary.BigEndian.PutUint16(pkt[10:12], bch.Checksum(pkt[2:10]))
+
+	return
+}
+
+// Synthesizes IQ samples of the given packet Manchester coded and on-off
+// keyed, surrounded by gap samples of noise on either side. The carrier is
+// offset by a sixteenth of the sample rate.
+func Synthesize(cfg decode.PacketConfig, pkt []byte, gap int, rng *rand.Rand) (iq []byte) {
+	var signal []float64
+	for idx := 0; idx < gap; idx++ {
+		signal = append(signal, 0)
+	}
+
+	for _, b := range pkt {
+		for bitIdx := uint(0); bitIdx < 8; bitIdx++ {
+			bit := float64(b >> (7 - bitIdx) & 1)
+			for idx := 0; idx < cfg.SymbolLength; idx++ {
+				signal = append(signal, bit*Amplitude)
+			}
+			for idx := 0; idx < cfg.SymbolLength; idx++ {
+				signal = append(signal, (1-bit)*Amplitude)
+			}
+		}
+	}
+
+	for idx := 0; idx < gap; idx++ {
+		signal = append(signal, 0)
+	}
+
+	iq = make([]byte, len(signal)<<1)
+	for idx, amp := range signal {
+		phase := 2 * math.Pi * float64(idx) / 16
+		i := 127.4 + amp*math.Cos(phase) + rng.NormFloat64()*NoiseLevel
+		q := 127.4 + amp*math.Sin(phase) + rng.NormFloat64()*NoiseLevel
+		iq[idx<<1] = Clip(i)
+		iq[idx<<1+1] = Clip(q)
+	}
+
+	return
+}
+
+// Rounds v to the nearest sample value, clipping to [0, 255].
+func Clip(v float64) byte {
+	return byte(math.Max(0, math.Min(255, math.Floor(v+0.5))))
+}
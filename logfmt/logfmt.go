@@ -0,0 +1,135 @@
+// Package logfmt encodes values as logfmt lines of space separated key=value
+// pairs.
+package logfmt
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// An Encoder writes logfmt lines to an output stream.
+type Encoder struct {
+	w io.Writer
+}
+
+// NewEncoder returns a new encoder that writes to w.
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// Has a message type to append as the msg_type key.
+type msgTyper interface {
+	MsgType() string
+}
+
+// Encode writes a line of the fields v encodes to in json followed by a
+// newline. Fields of nested objects are keyed by their path joined with
+// dots, except those of a top-level Message field which are promoted.
+// Arrays of values are joined with commas. Keys are in json field order,
+// followed by msg_type if v has a MsgType method.
+func (enc *Encoder) Encode(v interface{}) (err error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var pairs []string
+	if err = flatten(dec, "", &pairs); err != nil {
+		return err
+	}
+
+	if mt, ok := v.(msgTyper); ok {
+		pairs = append(pairs, "msg_type="+quote(mt.MsgType()))
+	}
+
+	_, err = io.WriteString(enc.w, strings.Join(pairs, " ")+"\n")
+	return err
+}
+
+// Reads a single json value from dec, appending key=value pairs of it to
+// pairs.
+func flatten(dec *json.Decoder, key string, pairs *[]string) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+
+	switch tok {
+	case json.Delim('{'):
+		for dec.More() {
+			tok, err := dec.Token()
+			if err != nil {
+				return err
+			}
+
+			field := tok.(string)
+			switch {
+			case key == "" && field == "Message":
+				field = ""
+			case key != "":
+				field = key + "." + field
+			}
+
+			if err := flatten(dec, field, pairs); err != nil {
+				return err
+			}
+		}
+		_, err = dec.Token()
+		return err
+	case json.Delim('['):
+		var values []string
+		for dec.More() {
+			var value interface{}
+			if err := dec.Decode(&value); err != nil {
+				return err
+			}
+			values = append(values, format(value))
+		}
+		*pairs = append(*pairs, key+"="+quote(strings.Join(values, ",")))
+		_, err = dec.Token()
+		return err
+	}
+
+	*pairs = append(*pairs, key+"="+format(tok))
+	return nil
+}
+
+// Formats a json scalar as a logfmt value.
+func format(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case bool:
+		return strconv.FormatBool(v)
+	case json.Number:
+		return v.String()
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case string:
+		return quote(v)
+	}
+
+	// Nested arrays and objects in arrays.
+	data, _ := json.Marshal(value)
+	return quote(string(data))
+}
+
+// Quotes values which are empty or contain spaces, equals signs, quotes or
+// control characters.
+func quote(s string) string {
+	if s == "" {
+		return `""`
+	}
+	for _, r := range s {
+		if r <= ' ' || r == '=' || r == '"' || r == '\\' || r == 0x7F {
+			return strconv.Quote(s)
+		}
+	}
+	return s
+}
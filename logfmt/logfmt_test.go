@@ -0,0 +1,50 @@
+package logfmt
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+type message struct {
+	ID          uint32
+	Consumption uint32
+	Intervals   []uint16
+}
+
+type logMessage struct {
+	Time    time.Time
+	Message message
+	Note    string            `json:",omitempty"`
+	Tags    map[string]string `json:"tags,omitempty"`
+}
+
+func (msg logMessage) MsgType() string {
+	return "SCM"
+}
+
+func TestEncode(t *testing.T) {
+	tests := []struct {
+		msg      logMessage
+		expected string
+	}{
+		{
+			logMessage{Time: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), Message: message{12345678, 98765, []uint16{1, 2, 3}}},
+			"Time=2024-01-01T00:00:00Z ID=12345678 Consumption=98765 Intervals=1,2,3 msg_type=SCM\n",
+		},
+		{
+			logMessage{Time: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), Note: `say "hi"`, Tags: map[string]string{"site": "building A"}},
+			`Time=2024-01-01T00:00:00Z ID=0 Consumption=0 Intervals= Note="say \"hi\"" tags.site="building A" msg_type=SCM` + "\n",
+		},
+	}
+
+	for _, test := range tests {
+		var buf bytes.Buffer
+		if err := NewEncoder(&buf).Encode(test.msg); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != test.expected {
+			t.Errorf("expected %q, got %q", test.expected, buf.String())
+		}
+	}
+}
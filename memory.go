@@ -0,0 +1,77 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2014 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"log"
+	"runtime"
+	"time"
+)
+
+// Returns the bytes of heap in use, replaceable for testing.
+var heapInuse = func() uint64 {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.HeapInuse
+}
+
+// Polls heap in use every interval until ctx is done, sending it on the
+// returned channel whenever it exceeds limit bytes. Samples are dropped while
+// the receiver is busy.
+func watchMemory(ctx context.Context, limit uint64, interval time.Duration) <-chan uint64 {
+	exceeded := make(chan uint64, 1)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			if heap := heapInuse(); heap > limit {
+				select {
+				case exceeded <- heap:
+				default:
+				}
+			}
+		}
+	}()
+
+	return exceeded
+}
+
+// Handles heap in use exceeding limit bytes by writing buffered output and
+// collecting garbage. Returns false if the heap still exceeds 110% of the
+// limit afterwards and the receiver should shut down.
+func relieveMemory(heap, limit uint64) bool {
+	flushOutput()
+
+	log.Printf("Heap in use %d MB exceeds -max-memory of %d MB, collecting garbage\n", heap>>20, limit>>20)
+	runtime.GC()
+
+	if heap = heapInuse(); heap > limit+limit/10 {
+		log.Printf("Heap in use %d MB exceeds 110%% of -max-memory after garbage collection, shutting down\n", heap>>20)
+		return false
+	}
+
+	return true
+}
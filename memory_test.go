@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestWatchMemory(t *testing.T) {
+	defer func(f func() uint64) { heapInuse = f }(heapInuse)
+
+	heap := make(chan uint64, 1)
+	heap <- 1 << 20
+	heapInuse = func() uint64 {
+		select {
+		case h := <-heap:
+			return h
+		default:
+			return 3 << 20
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	select {
+	case h := <-watchMemory(ctx, 2<<20, time.Millisecond):
+		if h != 3<<20 {
+			t.Errorf("expected %d, got %d", 3<<20, h)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("limit exceeded but not reported")
+	}
+}
+
+func TestRelieveMemory(t *testing.T) {
+	defer func(f func() uint64) { heapInuse = f }(heapInuse)
+
+	const limit = 100 << 20
+
+	testCases := []struct {
+		name     string
+		afterGC  uint64
+		expected bool
+	}{
+		{"BelowLimit", limit - 1, true},
+		{"WithinMargin", limit + limit/10, true},
+		{"AboveMargin", limit + limit/10 + 1, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			heapInuse = func() uint64 { return tc.afterGC }
+			if got := relieveMemory(2*limit, limit); got != tc.expected {
+				t.Errorf("expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
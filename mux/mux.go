@@ -0,0 +1,202 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2014 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package mux shares a single rtl_tcp server between multiple clients. Every
+// client receives the dongle info and an identical copy of the sample stream.
+// Commands from the first connected client are forwarded to rtl_tcp, those
+// from other clients are ignored with a warning if they conflict.
+package mux
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+)
+
+// Length of the dongle info header sent by rtl_tcp.
+const InfoLength = 12
+
+// Bytes of samples read from rtl_tcp and sent to clients at once.
+const BlockSize = 16384
+
+// Blocks buffered for each client, blocks are dropped for clients which fall
+// further behind.
+const ClientBuffer = 64
+
+// Mux fans out samples from an rtl_tcp server to its clients.
+type Mux struct {
+	upstream net.Conn
+	info     []byte
+
+	mu      sync.Mutex
+	clients []*client
+	params  map[uint8]uint32
+}
+
+type client struct {
+	conn    net.Conn
+	blocks  chan []byte
+	done    chan struct{}
+	dropped int
+}
+
+// New reads the dongle info from an rtl_tcp connection.
+func New(upstream net.Conn) (*Mux, error) {
+	m := &Mux{
+		upstream: upstream,
+		info:     make([]byte, InfoLength),
+		params:   make(map[uint8]uint32),
+	}
+
+	if _, err := io.ReadFull(upstream, m.info); err != nil {
+		return nil, fmt.Errorf("reading dongle info: %s", err)
+	}
+
+	return m, nil
+}
+
+// Serve accepts clients from l until it's closed.
+func (m *Mux) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go m.handle(conn)
+	}
+}
+
+// Run reads samples from rtl_tcp and sends them to every client until the
+// connection fails.
+func (m *Mux) Run() error {
+	for {
+		block := make([]byte, BlockSize)
+		if _, err := io.ReadFull(m.upstream, block); err != nil {
+			return err
+		}
+
+		m.mu.Lock()
+		for _, c := range m.clients {
+			select {
+			case c.blocks <- block:
+			default:
+				if c.dropped == 0 {
+					log.Printf("Client %s is falling behind, dropping samples\n", c.conn.RemoteAddr())
+				}
+				c.dropped++
+			}
+		}
+		m.mu.Unlock()
+	}
+}
+
+func (m *Mux) handle(conn net.Conn) {
+	c := &client{
+		conn:   conn,
+		blocks: make(chan []byte, ClientBuffer),
+		done:   make(chan struct{}),
+	}
+	defer m.remove(c)
+
+	if _, err := conn.Write(m.info); err != nil {
+		return
+	}
+
+	m.mu.Lock()
+	m.clients = append(m.clients, c)
+	if len(m.clients) == 1 {
+		log.Printf("Client %s connected, controlling hardware\n", conn.RemoteAddr())
+	} else {
+		log.Printf("Client %s connected\n", conn.RemoteAddr())
+	}
+	m.mu.Unlock()
+
+	go func() {
+		for {
+			select {
+			case <-c.done:
+				return
+			case block := <-c.blocks:
+				if _, err := conn.Write(block); err != nil {
+					conn.Close()
+					return
+				}
+			}
+		}
+	}()
+
+	cmd := make([]byte, 5)
+	for {
+		if _, err := io.ReadFull(conn, cmd); err != nil {
+			return
+		}
+		if err := m.command(c, cmd[0], binary.BigEndian.Uint32(cmd[1:])); err != nil {
+			log.Println("Error sending command to rtl_tcp:", err)
+			return
+		}
+	}
+}
+
+// Forwards a command to rtl_tcp if the client is the first connected.
+func (m *Mux) command(c *client, cmd uint8, param uint32) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.clients[0] != c {
+		if current, ok := m.params[cmd]; !ok || current != param {
+			log.Printf("Ignoring command 0x%02X %d from %s, hardware is controlled by %s\n",
+				cmd, param, c.conn.RemoteAddr(), m.clients[0].conn.RemoteAddr(),
+			)
+		}
+		return nil
+	}
+
+	buf := make([]byte, 5)
+	buf[0] = cmd
+	binary.BigEndian.PutUint32(buf[1:], param)
+	if _, err := m.upstream.Write(buf); err != nil {
+		return err
+	}
+
+	m.params[cmd] = param
+	return nil
+}
+
+func (m *Mux) remove(c *client) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	owner := len(m.clients) > 0 && m.clients[0] == c
+	for idx, other := range m.clients {
+		if other == c {
+			m.clients = append(m.clients[:idx], m.clients[idx+1:]...)
+			break
+		}
+	}
+
+	close(c.done)
+	c.conn.Close()
+	log.Printf("Client %s disconnected\n", c.conn.RemoteAddr())
+
+	// The next oldest client takes control, the hardware keeps its current
+	// settings until it sends commands of its own.
+	if owner && len(m.clients) > 0 {
+		log.Printf("Client %s now controlling hardware\n", m.clients[0].conn.RemoteAddr())
+	}
+}
@@ -0,0 +1,112 @@
+package mux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func command(cmd uint8, param uint32) []byte {
+	buf := make([]byte, 5)
+	buf[0] = cmd
+	binary.BigEndian.PutUint32(buf[1:], param)
+	return buf
+}
+
+// Connects a client and waits for it to be registered.
+func connect(t *testing.T, m *Mux, addr string, clients int) net.Conn {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info := make([]byte, InfoLength)
+	if _, err := io.ReadFull(conn, info); err != nil {
+		t.Fatal(err)
+	}
+	if string(info[:4]) != "RTL0" {
+		t.Fatalf("expected dongle info, got %q", info)
+	}
+
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		m.mu.Lock()
+		n := len(m.clients)
+		m.mu.Unlock()
+		if n == clients {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d clients, got %d", clients, n)
+		}
+	}
+
+	return conn
+}
+
+func TestMux(t *testing.T) {
+	upstream, server := net.Pipe()
+	defer upstream.Close()
+	defer server.Close()
+
+	go server.Write([]byte("RTL0\x00\x00\x00\x05\x00\x00\x00\x1d"))
+
+	m, err := New(upstream)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go m.Serve(l)
+
+	first := connect(t, m, l.Addr().String(), 1)
+	defer first.Close()
+	second := connect(t, m, l.Addr().String(), 2)
+	defer second.Close()
+
+	go m.Run()
+
+	// Both clients receive identical samples.
+	block := bytes.Repeat([]byte{0x7F, 0x80, 0x01, 0xFE}, BlockSize/4)
+	go server.Write(block)
+
+	for _, conn := range []net.Conn{first, second} {
+		received := make([]byte, BlockSize)
+		if _, err := io.ReadFull(conn, received); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(received, block) {
+			t.Errorf("client %s received different samples", conn.LocalAddr())
+		}
+	}
+
+	// Commands from the first client are forwarded, the second client's are
+	// ignored.
+	forwarded := make([]byte, 5)
+
+	first.Write(command(0x01, 912600155))
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(server, forwarded); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(forwarded, command(0x01, 912600155)) {
+		t.Errorf("expected center frequency command, got %02X", forwarded)
+	}
+
+	second.Write(command(0x02, 2359296))
+	time.Sleep(50 * time.Millisecond)
+
+	first.Write(command(0x02, 2392064))
+	if _, err := io.ReadFull(server, forwarded); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(forwarded, command(0x02, 2392064)) {
+		t.Errorf("expected first client's sample rate command, got %02X", forwarded)
+	}
+}
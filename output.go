@@ -0,0 +1,248 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2014 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/bemasher/rtlamr/csv"
+	"github.com/bemasher/rtlamr/logfmt"
+	"github.com/bemasher/rtlamr/parse"
+	"github.com/bemasher/rtlamr/protobuf"
+)
+
+// JSON, XML and GOB all implement this interface so we can simplify log
+// output formatting.
+type Encoder interface {
+	Encode(interface{}) error
+}
+
+// Returns an encoder for the given format writing to w. A nil encoder is
+// plain-text output.
+func NewEncoder(format string, w io.Writer) Encoder {
+	switch format {
+	case "csv":
+		return csv.NewEncoder(w)
+	case "json":
+		if len(fieldMap) > 0 {
+			return NewFieldMapEncoder(w, fieldMap)
+		}
+		return json.NewEncoder(w)
+	case "logfmt":
+		return logfmt.NewEncoder(w)
+	case "xml":
+		return xml.NewEncoder(w)
+	case "gob":
+		return gob.NewEncoder(w)
+	case "protobuf":
+		return protobuf.NewEncoder(w)
+	}
+	return nil
+}
+
+// Writes a single message to w using the given encoder.
+func WriteMessage(w io.Writer, enc Encoder, msg parse.LogMessage) (err error) {
+	if enc == nil {
+		// A nil encoder is just plain-text output.
+		if *sampleFilename == os.DevNull {
+			_, err = fmt.Fprintln(w, msg.StringNoOffset())
+		} else {
+			_, err = fmt.Fprintln(w, msg)
+		}
+		return
+	}
+
+	err = enc.Encode(msg)
+	if err != nil {
+		return
+	}
+
+	// The XML encoder doesn't write new lines after each element, add them.
+	if _, ok := enc.(*xml.Encoder); ok {
+		_, err = fmt.Fprintln(w)
+	}
+
+	return
+}
+
+// LineWriter writes each line written to it to w wrapped by a prefix and
+// suffix. Partial lines are held until their newline is written.
+type LineWriter struct {
+	w      io.Writer
+	prefix []byte
+	suffix []byte
+	buf    []byte
+}
+
+func NewLineWriter(w io.Writer, prefix, suffix string) *LineWriter {
+	return &LineWriter{w: w, prefix: []byte(prefix), suffix: []byte(suffix)}
+}
+
+func (lw *LineWriter) Write(p []byte) (n int, err error) {
+	lw.buf = append(lw.buf, p...)
+
+	for {
+		idx := bytes.IndexByte(lw.buf, '\n')
+		if idx < 0 {
+			break
+		}
+
+		line := make([]byte, 0, len(lw.prefix)+idx+len(lw.suffix)+1)
+		line = append(line, lw.prefix...)
+		line = append(line, lw.buf[:idx]...)
+		line = append(line, lw.suffix...)
+		line = append(line, '\n')
+
+		if _, err = lw.w.Write(line); err != nil {
+			return 0, err
+		}
+		lw.buf = lw.buf[idx+1:]
+	}
+
+	return len(p), nil
+}
+
+// A Sink receives every message in addition to the log file.
+type Sink interface {
+	Write(parse.LogMessage) error
+	Close() error
+	String() string
+}
+
+// FileSink writes messages to a file in its own format.
+type FileSink struct {
+	filename string
+	format   string
+	file     *os.File
+	enc      Encoder
+}
+
+func NewFileSink(filename, format string) (sink *FileSink, err error) {
+	sink = &FileSink{filename: filename, format: format}
+	sink.file, err = os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	sink.enc = NewEncoder(format, sink.file)
+	return
+}
+
+func (sink *FileSink) Write(msg parse.LogMessage) error {
+	return WriteMessage(sink.file, sink.enc, msg)
+}
+
+func (sink *FileSink) Close() error {
+	return sink.file.Close()
+}
+
+func (sink *FileSink) String() string {
+	return "file:" + sink.filename + ":" + sink.format
+}
+
+// OutputList is a repeatable flag of additional outputs of the form
+// file:path:format.
+type OutputList []string
+
+func (l *OutputList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *OutputList) Set(value string) error {
+	if !strings.HasPrefix(value, "file:") {
+		return fmt.Errorf("unknown output type: %q", value)
+	}
+
+	idx := strings.LastIndex(value, ":")
+	if idx <= len("file:") {
+		return fmt.Errorf("output must be of the form file:path:format: %q", value)
+	}
+	if _, ok := formatExt[strings.ToLower(value[idx+1:])]; !ok {
+		return fmt.Errorf("unknown output format: %q", value[idx+1:])
+	}
+
+	*l = append(*l, value)
+	return nil
+}
+
+// Creates a sink for each output.
+func (l OutputList) Sinks() (sinks []Sink, err error) {
+	for _, value := range l {
+		idx := strings.LastIndex(value, ":")
+		filename := value[len("file:"):idx]
+		format := strings.ToLower(value[idx+1:])
+
+		sink, err := NewFileSink(filename, format)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+	return
+}
+
+// Writes msg to each sink, exiting on error. Sinks may hold on to messages,
+// each is given its own copy. With -concurrent-output sinks are written in
+// parallel, returning once all have finished so no sink is written to by
+// more than one goroutine at a time.
+func writeSinks(msg parse.LogMessage) {
+	if !*concurrentOutput || len(sinks) < 2 {
+		for _, sink := range sinks {
+			if err := sink.Write(msg.Clone()); err != nil {
+				log.Fatalf("Error writing to output %s: %s\n", sink, err)
+			}
+		}
+		return
+	}
+
+	errs := make([]error, len(sinks))
+
+	var wg sync.WaitGroup
+	wg.Add(len(sinks))
+	for idx, sink := range sinks {
+		go func(idx int, sink Sink, msg parse.LogMessage) {
+			defer wg.Done()
+			errs[idx] = sink.Write(msg)
+		}(idx, sink, msg.Clone())
+	}
+	wg.Wait()
+
+	for idx, err := range errs {
+		if err != nil {
+			log.Fatalf("Error writing to output %s: %s\n", sinks[idx], err)
+		}
+	}
+}
+
+// Writes any buffered output to the log file.
+func flushOutput() {
+	if outputBuf == nil {
+		return
+	}
+
+	if err := outputBuf.Flush(); err != nil {
+		log.Fatal("Error writing output: ", err)
+	}
+}
@@ -0,0 +1,180 @@
+package parse
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// A BinaryMessage can be compactly encoded by LogMessage.MarshalBinary.
+type BinaryMessage interface {
+	Message
+	encoding.BinaryMarshaler
+
+	// Identifies the message type in the encoded header.
+	BinaryType() uint8
+}
+
+var binaryMessages = make(map[uint8]func([]byte) (Message, error))
+
+// Registers a function which decodes messages of the given binary type.
+// Message packages register themselves when imported.
+func RegisterBinaryMessage(msgType uint8, unmarshal func([]byte) (Message, error)) {
+	binaryMessages[msgType] = unmarshal
+}
+
+type binaryHeader struct {
+	MsgType uint8
+	Time    int64
+	Offset  int64
+	Length  uint32
+}
+
+// MarshalBinary encodes a header of message type, time in nanoseconds since
+// the unix epoch, offset and length followed by the length-prefixed
+// message, raw packet and warnings. A trailing byte records checksum
+// validity if known: 1 for valid, 0 for invalid, 2 for unknown when followed
+// by tags. Tags follow as a count and length-prefixed key-value pairs if
+// any. All values are big-endian.
+func (msg LogMessage) MarshalBinary() (data []byte, err error) {
+	bm, ok := msg.Message.(BinaryMessage)
+	if !ok {
+		return nil, errors.New("message does not satisfy BinaryMessage interface")
+	}
+
+	payload, err := bm.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	hdr := binaryHeader{bm.BinaryType(), msg.Time.UnixNano(), msg.Offset, uint32(msg.Length)}
+	binary.Write(&buf, binary.BigEndian, hdr)
+
+	writeBytes(&buf, payload)
+	writeBytes(&buf, []byte(msg.RawPacket))
+
+	binary.Write(&buf, binary.BigEndian, uint16(len(msg.Warnings)))
+	for _, warning := range msg.Warnings {
+		writeBytes(&buf, []byte(warning))
+	}
+
+	if msg.CRCValid != nil {
+		if *msg.CRCValid {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+	} else if len(msg.Tags) > 0 {
+		buf.WriteByte(2)
+	}
+
+	if len(msg.Tags) > 0 {
+		binary.Write(&buf, binary.BigEndian, uint16(len(msg.Tags)))
+		for _, key := range msg.Tags.Keys() {
+			writeBytes(&buf, []byte(key))
+			writeBytes(&buf, []byte(msg.Tags[key]))
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes a message encoded by MarshalBinary. The message
+// type must have been registered by importing its package.
+func (msg *LogMessage) UnmarshalBinary(data []byte) (err error) {
+	buf := bytes.NewReader(data)
+
+	var hdr binaryHeader
+	if err = binary.Read(buf, binary.BigEndian, &hdr); err != nil {
+		return
+	}
+
+	unmarshal, ok := binaryMessages[hdr.MsgType]
+	if !ok {
+		return fmt.Errorf("unknown binary message type: %d", hdr.MsgType)
+	}
+
+	payload, err := readBytes(buf)
+	if err != nil {
+		return
+	}
+
+	raw, err := readBytes(buf)
+	if err != nil {
+		return
+	}
+
+	var count uint16
+	if err = binary.Read(buf, binary.BigEndian, &count); err != nil {
+		return
+	}
+
+	var warnings []string
+	for idx := uint16(0); idx < count; idx++ {
+		warning, err := readBytes(buf)
+		if err != nil {
+			return err
+		}
+		warnings = append(warnings, string(warning))
+	}
+
+	// Checksum validity and tags are optional.
+	var crcValid *bool
+	if valid, err := buf.ReadByte(); err == nil && valid != 2 {
+		crcValid = new(bool)
+		*crcValid = valid == 1
+	}
+
+	var tags Tags
+	if err := binary.Read(buf, binary.BigEndian, &count); err == nil {
+		tags = make(Tags, count)
+		for idx := uint16(0); idx < count; idx++ {
+			key, err := readBytes(buf)
+			if err != nil {
+				return err
+			}
+			value, err := readBytes(buf)
+			if err != nil {
+				return err
+			}
+			tags[string(key)] = string(value)
+		}
+	}
+
+	m, err := unmarshal(payload)
+	if err != nil {
+		return
+	}
+
+	msg.Time = time.Unix(0, hdr.Time)
+	msg.Offset = hdr.Offset
+	msg.Length = int(hdr.Length)
+	msg.Message = m
+	msg.RawPacket = string(raw)
+	msg.Warnings = warnings
+	msg.CRCValid = crcValid
+	msg.Tags = tags
+
+	return nil
+}
+
+func writeBytes(buf *bytes.Buffer, data []byte) {
+	binary.Write(buf, binary.BigEndian, uint16(len(data)))
+	buf.Write(data)
+}
+
+func readBytes(buf *bytes.Reader) (data []byte, err error) {
+	var length uint16
+	if err = binary.Read(buf, binary.BigEndian, &length); err != nil {
+		return
+	}
+
+	data = make([]byte, length)
+	_, err = io.ReadFull(buf, data)
+	return
+}
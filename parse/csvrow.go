@@ -0,0 +1,125 @@
+package parse
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// ToCSVRow returns the named columns of msg as a single CSV row, without a
+// trailing newline. Columns are named as in json output: fields of the log
+// message such as Time, raw_packet or tags, then fields of the message
+// itself such as ID or Consumption. Fields which are absent, such as an
+// unset crc_valid, are empty. Slices, maps and structs other than times are
+// written as json. Values are quoted as needed by encoding/csv.
+func (msg LogMessage) ToCSVRow(columns []string) (string, error) {
+	logFields := jsonFields(reflect.ValueOf(msg))
+	var msgFields map[string]reflect.Value
+	if msg.Message != nil {
+		msgFields = jsonFields(reflect.ValueOf(msg.Message))
+	}
+
+	record := make([]string, len(columns))
+	for idx, column := range columns {
+		field, ok := logFields[column]
+		if !ok {
+			field, ok = msgFields[column]
+		}
+		if !ok {
+			return "", fmt.Errorf("unknown column %q", column)
+		}
+
+		value, err := csvValue(field)
+		if err != nil {
+			return "", fmt.Errorf("column %q: %s", column, err)
+		}
+		record[idx] = value
+	}
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write(record)
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return "", err
+	}
+
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
+
+// Returns the exported fields of the struct v, or the struct v points to,
+// keyed by their json names. Embedded interfaces such as a LogMessage's
+// Message aren't included. Values other than structs have no fields.
+func jsonFields(v reflect.Value) map[string]reflect.Value {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return nil
+	}
+
+	fields := map[string]reflect.Value{}
+	t := v.Type()
+	for idx := 0; idx < t.NumField(); idx++ {
+		f := t.Field(idx)
+		if f.PkgPath != "" || (f.Anonymous && f.Type.Kind() == reflect.Interface) {
+			continue
+		}
+
+		name := f.Name
+		if tag := strings.Split(f.Tag.Get("json"), ",")[0]; tag == "-" {
+			continue
+		} else if tag != "" {
+			name = tag
+		}
+		fields[name] = v.Field(idx)
+	}
+
+	return fields
+}
+
+// Formats a single field for ToCSVRow.
+func csvValue(v reflect.Value) (string, error) {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return "", nil
+		}
+		v = v.Elem()
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		return v.String(), nil
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10), nil
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(v.Float(), 'f', -1, v.Type().Bits()), nil
+	}
+
+	if v.Type() == timeType {
+		return v.Interface().(time.Time).Format(time.RFC3339Nano), nil
+	}
+	if (v.Kind() == reflect.Slice || v.Kind() == reflect.Map) && v.IsNil() {
+		return "", nil
+	}
+
+	data, err := json.Marshal(v.Interface())
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
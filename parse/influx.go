@@ -0,0 +1,110 @@
+package parse
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Measurement name of points returned by LogMessage.ToInfluxPoint.
+const InfluxMeasurement = "rtlamr"
+
+// A FieldMessage reports protocol-specific fields for outputs which store
+// messages as field sets, such as InfluxDB. Values must be integers,
+// floats, bools or strings.
+type FieldMessage interface {
+	ExtraFields() map[string]interface{}
+}
+
+var (
+	influxTagEscaper    = strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`)
+	influxStringEscaper = strings.NewReplacer(`"`, `\"`, `\`, `\\`)
+)
+
+// ToInfluxPoint returns the message as a line of InfluxDB line protocol,
+// without a trailing newline. The message type, meter id, meter type and any
+// of the message's Tags are tags. Fields are given by the message's
+// ExtraFields if it is a FieldMessage, the meter id is always stored as the
+// field meter_id too so the point has at least one field. The timestamp is
+// in nanoseconds.
+func (msg LogMessage) ToInfluxPoint() string {
+	fields := map[string]interface{}{}
+	if fm, ok := msg.Message.(FieldMessage); ok {
+		for key, value := range fm.ExtraFields() {
+			fields[key] = value
+		}
+	}
+	fields["meter_id"] = msg.MeterID()
+
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	tags := Tags{
+		"meter_id":   strconv.FormatUint(uint64(msg.MeterID()), 10),
+		"meter_type": strconv.FormatUint(uint64(msg.MeterType()), 10),
+		"msg_type":   msg.MsgType(),
+	}
+	for key, value := range msg.Tags {
+		tags[key] = value
+	}
+
+	var b strings.Builder
+	b.WriteString(InfluxMeasurement)
+	for _, key := range tags.Keys() {
+		fmt.Fprintf(&b, ",%s=%s", influxTagEscaper.Replace(key), influxTagEscaper.Replace(tags[key]))
+	}
+
+	for idx, key := range keys {
+		if idx == 0 {
+			b.WriteByte(' ')
+		} else {
+			b.WriteByte(',')
+		}
+		b.WriteString(influxTagEscaper.Replace(key))
+		b.WriteByte('=')
+		b.WriteString(influxFieldValue(fields[key]))
+	}
+
+	fmt.Fprintf(&b, " %d", msg.Time.UnixNano())
+
+	return b.String()
+}
+
+// Formats a field value, integers are suffixed with i and strings quoted.
+func influxFieldValue(value interface{}) string {
+	switch v := value.(type) {
+	case int:
+		return strconv.FormatInt(int64(v), 10) + "i"
+	case int8:
+		return strconv.FormatInt(int64(v), 10) + "i"
+	case int16:
+		return strconv.FormatInt(int64(v), 10) + "i"
+	case int32:
+		return strconv.FormatInt(int64(v), 10) + "i"
+	case int64:
+		return strconv.FormatInt(v, 10) + "i"
+	case uint:
+		return strconv.FormatUint(uint64(v), 10) + "i"
+	case uint8:
+		return strconv.FormatUint(uint64(v), 10) + "i"
+	case uint16:
+		return strconv.FormatUint(uint64(v), 10) + "i"
+	case uint32:
+		return strconv.FormatUint(uint64(v), 10) + "i"
+	case uint64:
+		return strconv.FormatUint(v, 10) + "i"
+	case float32:
+		return strconv.FormatFloat(float64(v), 'g', -1, 32)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	case string:
+		return `"` + influxStringEscaper.Replace(v) + `"`
+	}
+	return `"` + influxStringEscaper.Replace(fmt.Sprint(value)) + `"`
+}
@@ -0,0 +1,40 @@
+package parse
+
+import "sort"
+
+// MeterTypeName maps ERT type codes to the commodity they meter. Compiled
+// from meters.md.
+var MeterTypeName = map[uint8]string{
+	2:  "gas",
+	4:  "electric",
+	5:  "electric",
+	7:  "electric",
+	8:  "electric",
+	9:  "gas",
+	11: "water",
+	12: "gas",
+	13: "water",
+}
+
+// MeterTypeCodes returns the ERT type codes for the given commodity name.
+func MeterTypeCodes(name string) (codes []uint8) {
+	for code := 0; code < 0x100; code++ {
+		if n, ok := MeterTypeName[uint8(code)]; ok && n == name {
+			codes = append(codes, uint8(code))
+		}
+	}
+	return
+}
+
+// MeterTypeNames returns a sorted list of known commodity names.
+func MeterTypeNames() (names []string) {
+	seen := make(map[string]bool)
+	for _, n := range MeterTypeName {
+		if !seen[n] {
+			seen[n] = true
+			names = append(names, n)
+		}
+	}
+	sort.Strings(names)
+	return
+}
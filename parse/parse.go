@@ -1,73 +1,247 @@
-package parse
-
-import (
-	"fmt"
-	"strconv"
-	"time"
-
-	"github.com/bemasher/rtlamr/csv"
-)
-
-const (
-	TimeFormat = "2006-01-02T15:04:05.000"
-)
-
-type Data struct {
-	Bits  string
-	Bytes []byte
-}
-
-func NewDataFromBytes(data []byte) (d Data) {
-	d.Bytes = data
-	for _, b := range data {
-		d.Bits += fmt.Sprintf("%08b", b)
-	}
-
-	return
-}
-
-func NewDataFromBits(data string) (d Data) {
-	d.Bits = data
-	d.Bytes = make([]byte, len(data)>>3+1)
-	for idx := 0; idx < len(data); idx += 8 {
-		b, _ := strconv.ParseUint(d.Bits[idx:idx+8], 2, 8)
-		d.Bytes[idx>>3] = uint8(b)
-	}
-	return
-}
-
-type Parser interface {
-	Parse(Data) (Message, error)
-}
-
-type Message interface {
-	MsgType() string
-	MeterID() uint32
-	MeterType() uint8
-	csv.Recorder
-}
-
-type LogMessage struct {
-	Time   time.Time
-	Offset int64
-	Length int
-	Message
-}
-
-func (msg LogMessage) String() string {
-	return fmt.Sprintf("{Time:%s Offset:%d Length:%d %s:%s}",
-		msg.Time.Format(TimeFormat), msg.Offset, msg.Length, msg.MsgType(), msg.Message,
-	)
-}
-
-func (msg LogMessage) StringNoOffset() string {
-	return fmt.Sprintf("{Time:%s %s:%s}", msg.Time.Format(TimeFormat), msg.MsgType(), msg.Message)
-}
-
-func (msg LogMessage) Record() (r []string) {
-	r = append(r, msg.Time.Format(time.RFC3339Nano))
-	r = append(r, strconv.FormatInt(msg.Offset, 10))
-	r = append(r, strconv.FormatInt(int64(msg.Length), 10))
-	r = append(r, msg.Message.Record()...)
-	return r
-}
+package parse
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bemasher/rtlamr/crc"
+	"github.com/bemasher/rtlamr/csv"
+)
+
+const (
+	TimeFormat = "2006-01-02T15:04:05.000"
+)
+
+type Data struct {
+	Bits  string
+	Bytes []byte
+}
+
+func NewDataFromBytes(data []byte) (d Data) {
+	d.Bytes = data
+	for _, b := range data {
+		d.Bits += fmt.Sprintf("%08b", b)
+	}
+
+	return
+}
+
+// Extract returns numBits bits starting at startBit, counting from the most
+// significant bit of the first byte, as an unsigned integer. Fields may be up
+// to 64 bits long and needn't be byte aligned. Panics if the field extends
+// past the end of the data.
+func (d Data) Extract(startBit, numBits int) (v uint64) {
+	for idx := startBit; idx < startBit+numBits; idx++ {
+		v = v<<1 | uint64(d.Bytes[idx>>3]>>(7-uint(idx&7))&1)
+	}
+	return v
+}
+
+// ExtractSigned is like Extract but interprets the field as a two's
+// complement signed integer.
+func (d Data) ExtractSigned(startBit, numBits int) int64 {
+	v := d.Extract(startBit, numBits)
+	if numBits > 0 && numBits < 64 && v>>uint(numBits-1)&1 == 1 {
+		v |= ^uint64(0) << uint(numBits)
+	}
+	return int64(v)
+}
+
+// NewDataFromHex decodes a hex string, which may contain whitespace between
+// bytes, such as packet dumps from logs or issue reports.
+func NewDataFromHex(hexStr string) (d Data, err error) {
+	data, err := hex.DecodeString(strings.Join(strings.Fields(hexStr), ""))
+	if err != nil {
+		return d, err
+	}
+
+	return NewDataFromBytes(data), nil
+}
+
+func NewDataFromBits(data string) (d Data) {
+	d.Bits = data
+	d.Bytes = make([]byte, len(data)>>3+1)
+	for idx := 0; idx < len(data); idx += 8 {
+		b, _ := strconv.ParseUint(d.Bits[idx:idx+8], 2, 8)
+		d.Bytes[idx>>3] = uint8(b)
+	}
+	return
+}
+
+// A Field describes the location of a named bit field within a packet.
+type Field struct {
+	Name          string
+	Start, Length int
+}
+
+// BitString returns the data's bits grouped into space-separated bytes. If
+// fields are given, bits are instead grouped by field and labelled with the
+// field's name, e.g. "ID=0101 Type=11".
+func (d Data) BitString(fields ...Field) string {
+	var groups []string
+	if len(fields) == 0 {
+		for idx := 0; idx < len(d.Bits); idx += 8 {
+			end := idx + 8
+			if end > len(d.Bits) {
+				end = len(d.Bits)
+			}
+			groups = append(groups, d.Bits[idx:end])
+		}
+		return strings.Join(groups, " ")
+	}
+
+	for _, f := range fields {
+		end := f.Start + f.Length
+		if end > len(d.Bits) {
+			end = len(d.Bits)
+		}
+		start := f.Start
+		if start > end {
+			start = end
+		}
+		groups = append(groups, f.Name+"="+d.Bits[start:end])
+	}
+	return strings.Join(groups, " ")
+}
+
+// CheckCRC reports whether data.Bytes[start:end] is long enough and its
+// checksum matches the residue of the given CRC.
+func CheckCRC(data Data, c crc.CRC, start, end int) bool {
+	if len(data.Bytes) < end {
+		return false
+	}
+	return c.Checksum(data.Bytes[start:end]) == c.Residue
+}
+
+type Parser interface {
+	Parse(Data) (Message, error)
+
+	// Type returns the message type parsed, as given to -msgtype.
+	Type() string
+}
+
+// An UncheckedParser parses packets regardless of whether their checksum is
+// valid.
+type UncheckedParser interface {
+	ParseUnchecked(Data) (Message, error)
+}
+
+type Message interface {
+	MsgType() string
+	MeterID() uint32
+	MeterType() uint8
+	csv.Recorder
+}
+
+// CRCError describes a failed checksum: the checksum computed over the
+// packet and the residue expected for a valid packet.
+type CRCError struct {
+	Computed, Expected uint16
+}
+
+// NewCRCError computes the checksum of data.Bytes[start:end] for reporting a
+// failed CheckCRC.
+func NewCRCError(data Data, c crc.CRC, start, end int) CRCError {
+	if end > len(data.Bytes) {
+		end = len(data.Bytes)
+	}
+	return CRCError{c.Checksum(data.Bytes[start:end]), c.Residue}
+}
+
+func (e CRCError) Error() string {
+	return fmt.Sprintf("checksum failed: computed 0x%04X, expected 0x%04X", e.Computed, e.Expected)
+}
+
+// A Validator reports warnings about sanity of a message's field values.
+type Validator interface {
+	Validate() []string
+}
+
+type LogMessage struct {
+	Time   time.Time
+	Offset int64
+	Length int
+	Message
+
+	// Hex-encoded packet bytes as received, only populated by -include-raw.
+	RawPacket string `json:"raw_packet,omitempty" xml:",omitempty"`
+
+	// Field sanity warnings, only populated by -validate.
+	Warnings []string `json:"warnings,omitempty" xml:",omitempty"`
+
+	// Whether the packet's checksum was valid, only populated by
+	// -no-crc-filter.
+	CRCValid *bool `json:"crc_valid,omitempty" xml:",omitempty"`
+
+	// Static tags labeling the message, only populated by -tag.
+	Tags Tags `json:"tags,omitempty" xml:",omitempty"`
+}
+
+// A Cloner returns a deep copy of a message which shares no memory with the
+// original. Messages which hold slices should implement it.
+type Cloner interface {
+	Clone() Message
+}
+
+// Clone returns a deep copy of msg so outputs may hold on to or modify it
+// independently. Messages which don't implement Cloner are copied by value.
+func (msg LogMessage) Clone() LogMessage {
+	if c, ok := msg.Message.(Cloner); ok {
+		msg.Message = c.Clone()
+	}
+	if msg.Warnings != nil {
+		msg.Warnings = append([]string(nil), msg.Warnings...)
+	}
+	if msg.CRCValid != nil {
+		valid := *msg.CRCValid
+		msg.CRCValid = &valid
+	}
+	if msg.Tags != nil {
+		tags := make(Tags, len(msg.Tags))
+		for key, value := range msg.Tags {
+			tags[key] = value
+		}
+		msg.Tags = tags
+	}
+	return msg
+}
+
+// Age returns the time elapsed since msg was received.
+func (msg LogMessage) Age() time.Duration {
+	return time.Since(msg.Time)
+}
+
+// IsStale reports whether msg was received more than maxAge ago.
+func (msg LogMessage) IsStale(maxAge time.Duration) bool {
+	return msg.Age() > maxAge
+}
+
+func (msg LogMessage) String() string {
+	return fmt.Sprintf("{Time:%s Offset:%d Length:%d %s:%s}",
+		msg.Time.Format(TimeFormat), msg.Offset, msg.Length, msg.MsgType(), msg.Message,
+	)
+}
+
+func (msg LogMessage) StringNoOffset() string {
+	return fmt.Sprintf("{Time:%s %s:%s}", msg.Time.Format(TimeFormat), msg.MsgType(), msg.Message)
+}
+
+func (msg LogMessage) Record() (r []string) {
+	r = append(r, msg.Time.Format(time.RFC3339Nano))
+	r = append(r, strconv.FormatInt(msg.Offset, 10))
+	r = append(r, strconv.FormatInt(int64(msg.Length), 10))
+	r = append(r, msg.Message.Record()...)
+	if msg.RawPacket != "" {
+		r = append(r, msg.RawPacket)
+	}
+	if msg.CRCValid != nil {
+		r = append(r, strconv.FormatBool(*msg.CRCValid))
+	}
+	for _, key := range msg.Tags.Keys() {
+		r = append(r, msg.Tags[key])
+	}
+	return r
+}
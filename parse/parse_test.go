@@ -0,0 +1,278 @@
+package parse
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bemasher/rtlamr/crc"
+)
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestCheckCRC(t *testing.T) {
+	const (
+		scmPacket = "F953001C12D68798968140BB"
+		idmPacket = "555516A31C5CC6040702625A042A440100000000000003000000000000002625A00001C1C150E08C54311C0FC8C4D2A16CC469381DCFC854624D34A1542BD6CBD6232DA4D97039DDCF57E40E15118C47E4D2D9A4EE8405DCBEEFB326"
+	)
+
+	bch := crc.NewCRC("BCH", 0, 0x6F63, 0)
+	ccitt := crc.NewCRC("CCITT", 0xFFFF, 0x1021, 0x1D0F)
+
+	tests := []struct {
+		name       string
+		packet     string
+		crc        crc.CRC
+		start, end int
+		flip       int
+		valid      bool
+	}{
+		{"SCM", scmPacket, bch, 2, 12, -1, true},
+		{"SCM corrupt", scmPacket, bch, 2, 12, 5, false},
+		{"SCM short", scmPacket[:20], bch, 2, 12, -1, false},
+		{"IDM", idmPacket, ccitt, 4, 92, -1, true},
+		{"IDM corrupt", idmPacket, ccitt, 4, 92, 40, false},
+		{"IDM wrong CRC", idmPacket, bch, 4, 92, -1, false},
+	}
+
+	for _, test := range tests {
+		data := mustDecodeHex(t, test.packet)
+		if test.flip >= 0 {
+			data[test.flip] ^= 0x10
+		}
+
+		if valid := CheckCRC(NewDataFromBytes(data), test.crc, test.start, test.end); valid != test.valid {
+			t.Errorf("%s: expected %v, got %v", test.name, test.valid, valid)
+		}
+	}
+}
+
+func TestCRCError(t *testing.T) {
+	bch := crc.NewCRC("BCH", 0, 0x6F63, 0)
+
+	data := mustDecodeHex(t, "F953001C12D68798968140BB")
+	data[5] ^= 0x10
+
+	err := NewCRCError(NewDataFromBytes(data), bch, 2, 12)
+	if err.Expected != 0 || err.Computed == 0 {
+		t.Errorf("expected non-zero computed checksum and zero residue, got %+v", err)
+	}
+	if err.Computed != bch.Checksum(data[2:12]) {
+		t.Errorf("expected computed checksum 0x%04X, got 0x%04X", bch.Checksum(data[2:12]), err.Computed)
+	}
+}
+
+func TestNewDataFromHex(t *testing.T) {
+	for _, s := range []string{"35CA0F", "35 ca 0f", " 35CA\t0F\n"} {
+		data, err := NewDataFromHex(s)
+		if err != nil {
+			t.Errorf("%q: %s", s, err)
+			continue
+		}
+		if data.Bits != "001101011100101000001111" {
+			t.Errorf("%q: expected bits 001101011100101000001111, got %s", s, data.Bits)
+		}
+	}
+
+	if _, err := NewDataFromHex("35C"); err == nil {
+		t.Error("expected error for odd length string")
+	}
+	if _, err := NewDataFromHex("35 CG"); err == nil {
+		t.Error("expected error for invalid hex digit")
+	}
+}
+
+func TestExtract(t *testing.T) {
+	data := NewDataFromBytes([]byte{0x35, 0xCA, 0x0F, 0x80, 0x01, 0x23, 0x45, 0x67, 0x89, 0xFF})
+
+	tests := []struct {
+		name          string
+		start, length int
+		unsigned      uint64
+		signed        int64
+	}{
+		{"empty", 4, 0, 0, 0},
+		{"first bit", 0, 1, 0, 0},
+		{"single set bit", 2, 1, 1, -1},
+		{"last bit", 79, 1, 1, -1},
+		{"nibble", 0, 4, 0x3, 3},
+		{"byte", 8, 8, 0xCA, -54},
+		{"unaligned across bytes", 4, 8, 0x5C, 92},
+		{"unaligned short", 6, 5, 0x0E, 14},
+		{"sign bit only", 24, 8, 0x80, -128},
+		{"24 bits", 8, 24, 0xCA0F80, 0xCA0F80 - 1<<24},
+		{"64 bits", 0, 64, 0x35CA0F8001234567, 0x35CA0F8001234567},
+		{"64 bits negative", 8, 64, 0xCA0F800123456789, -0x35F07FFEDCBA9877},
+		{"64 bits unaligned", 1, 64, 0x6B941F0002468ACF, 0x6B941F0002468ACF},
+	}
+
+	for _, test := range tests {
+		if v := data.Extract(test.start, test.length); v != test.unsigned {
+			t.Errorf("%s: Extract(%d, %d) expected 0x%X, got 0x%X", test.name, test.start, test.length, test.unsigned, v)
+		}
+		if v := data.ExtractSigned(test.start, test.length); v != test.signed {
+			t.Errorf("%s: ExtractSigned(%d, %d) expected %d, got %d", test.name, test.start, test.length, test.signed, v)
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected panic extracting past end of data")
+		}
+	}()
+	data.Extract(76, 8)
+}
+
+func TestBitString(t *testing.T) {
+	data := NewDataFromBytes([]byte{0x35, 0xCA, 0x0F})
+
+	tests := []struct {
+		fields   []Field
+		expected string
+	}{
+		{nil, "00110101 11001010 00001111"},
+		{[]Field{{"A", 0, 4}, {"B", 4, 12}}, "A=0011 B=010111001010"},
+		{[]Field{{"Last", 20, 4}}, "Last=1111"},
+		{[]Field{{"Past", 22, 8}}, "Past=11"},
+	}
+
+	for _, test := range tests {
+		if bits := data.BitString(test.fields...); bits != test.expected {
+			t.Errorf("expected %q, got %q", test.expected, bits)
+		}
+	}
+
+	if bits := NewDataFromBytes(nil).BitString(); bits != "" {
+		t.Errorf("expected empty string, got %q", bits)
+	}
+}
+
+type fieldMessage map[string]interface{}
+
+func (m fieldMessage) MsgType() string                     { return "Test Type" }
+func (m fieldMessage) MeterID() uint32                     { return 12345 }
+func (m fieldMessage) MeterType() uint8                    { return 7 }
+func (m fieldMessage) Record() []string                    { return nil }
+func (m fieldMessage) ExtraFields() map[string]interface{} { return m }
+
+func TestToInfluxPoint(t *testing.T) {
+	tests := []struct {
+		msg      Message
+		expected string
+	}{
+		{
+			fieldMessage{"consumption": uint32(42), "ratio": 0.5, "ok": true, "note": `say "hi"`},
+			`rtlamr,meter_id=12345,meter_type=7,msg_type=Test\ Type consumption=42i,meter_id=12345i,note="say \"hi\"",ok=true,ratio=0.5 1500000000000000001`,
+		},
+		{
+			fieldMessage{},
+			`rtlamr,meter_id=12345,meter_type=7,msg_type=Test\ Type meter_id=12345i 1500000000000000001`,
+		},
+	}
+
+	for _, test := range tests {
+		msg := LogMessage{Time: time.Unix(1500000000, 1), Message: test.msg}
+		if point := msg.ToInfluxPoint(); point != test.expected {
+			t.Errorf("expected %q, got %q", test.expected, point)
+		}
+	}
+
+	// Static tags are sorted with the message's tags.
+	msg := LogMessage{Time: time.Unix(1500000000, 1), Message: fieldMessage{}, Tags: Tags{"site": "building A", "antenna": "roof"}}
+	expected := `rtlamr,antenna=roof,meter_id=12345,meter_type=7,msg_type=Test\ Type,site=building\ A meter_id=12345i 1500000000000000001`
+	if point := msg.ToInfluxPoint(); point != expected {
+		t.Errorf("expected %q, got %q", expected, point)
+	}
+}
+
+func TestAge(t *testing.T) {
+	msg := LogMessage{Time: time.Now().Add(-time.Minute)}
+
+	if age := msg.Age(); age < time.Minute || age > 2*time.Minute {
+		t.Errorf("expected age of about a minute, got %s", age)
+	}
+	if !msg.IsStale(30 * time.Second) {
+		t.Error("expected message received a minute ago to be stale after 30s")
+	}
+	if msg.IsStale(time.Hour) {
+		t.Error("expected message received a minute ago not to be stale after an hour")
+	}
+}
+
+type csvMessage struct {
+	ID        uint32
+	Note      string
+	Ratio     float64
+	Intervals []uint16
+	Private   string `json:"-"`
+}
+
+func (m csvMessage) MsgType() string  { return "Test Type" }
+func (m csvMessage) MeterID() uint32  { return m.ID }
+func (m csvMessage) MeterType() uint8 { return 7 }
+func (m csvMessage) Record() []string { return nil }
+
+func TestToCSVRow(t *testing.T) {
+	valid := true
+	msg := LogMessage{
+		Time:   time.Unix(1500000000, 1).UTC(),
+		Offset: 42,
+		Message: csvMessage{
+			ID:        12345,
+			Note:      `meter, "north" wall`,
+			Ratio:     0.5,
+			Intervals: []uint16{1, 2, 3},
+			Private:   "hidden",
+		},
+		CRCValid: &valid,
+		Tags:     Tags{"site": "a,b"},
+	}
+
+	columns := []string{"ID", "Time", "Offset", "Note", "Ratio", "Intervals", "crc_valid", "tags", "raw_packet"}
+	expected := []string{
+		"12345", "2017-07-14T02:40:00.000000001Z", "42", `meter, "north" wall`, "0.5",
+		"[1,2,3]", "true", `{"site":"a,b"}`, "",
+	}
+
+	row, err := msg.ToCSVRow(columns)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The row should be exactly what encoding/csv writes for the same values.
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write(expected)
+	w.Flush()
+	if row+"\n" != buf.String() {
+		t.Errorf("expected %q, got %q", buf.String(), row+"\n")
+	}
+
+	record, err := csv.NewReader(strings.NewReader(row)).Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(record) != len(expected) {
+		t.Fatalf("expected %d fields, got %d: %q", len(expected), len(record), record)
+	}
+	for idx := range expected {
+		if record[idx] != expected[idx] {
+			t.Errorf("column %s: expected %q, got %q", columns[idx], expected[idx], record[idx])
+		}
+	}
+
+	for _, column := range []string{"Private", "Message", "unknown"} {
+		if _, err := msg.ToCSVRow([]string{column}); err == nil {
+			t.Errorf("expected error for column %q", column)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package parse
+
+import (
+	"encoding/xml"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Tags are static key-value pairs labeling every message, such as the site
+// a receiver is deployed at.
+type Tags map[string]string
+
+// Names which can't be used as tag keys, they name fields of log messages or
+// InfluxDB tags. Compared case-insensitively.
+var ReservedTagNames = []string{
+	"time", "offset", "length", "meter_id", "meter_type", "msg_type",
+	"raw_packet", "warnings", "crc_valid", "tags",
+}
+
+// CheckTagName returns an error if name is empty or reserved.
+func CheckTagName(name string) error {
+	if name == "" {
+		return fmt.Errorf("empty tag name")
+	}
+	for _, reserved := range ReservedTagNames {
+		if strings.EqualFold(name, reserved) {
+			return fmt.Errorf("tag name is reserved: %q", name)
+		}
+	}
+	return nil
+}
+
+// Keys returns the tag keys in sorted order.
+func (t Tags) Keys() (keys []string) {
+	for key := range t {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return
+}
+
+// The XML encoder doesn't support maps, encode each tag as an element of the
+// form <Tag Key="key">value</Tag>.
+func (t Tags) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	if err := e.EncodeToken(start); err != nil {
+		return err
+	}
+
+	for _, key := range t.Keys() {
+		tag := struct {
+			Key   string `xml:",attr"`
+			Value string `xml:",chardata"`
+		}{key, t[key]}
+		if err := e.EncodeElement(tag, xml.StartElement{Name: xml.Name{Local: "Tag"}}); err != nil {
+			return err
+		}
+	}
+
+	return e.EncodeToken(start.End())
+}
@@ -0,0 +1,388 @@
+// Package protobuf encodes messages as proto3 MeterReading messages defined
+// by meterreading.proto, each preceded by its length as a 4-byte big-endian
+// integer. The wire format is encoded directly so no protobuf runtime is
+// needed.
+package protobuf
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bemasher/rtlamr/parse"
+)
+
+// Maximum length of a message accepted by the decoder.
+const MaxMessageLength = 1 << 20
+
+// Field numbers of MeterReading.
+const (
+	fieldTime = iota + 1
+	fieldMsgType
+	fieldMeterID
+	fieldMeterType
+	fieldFields
+	fieldTags
+	fieldRawPacket
+	fieldOffset
+	fieldLength
+	fieldWarnings
+	fieldCRCValid
+)
+
+// Wire types.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// MeterReading is the decoded form of the MeterReading message.
+type MeterReading struct {
+	Time      time.Time
+	MsgType   string
+	MeterID   uint32
+	MeterType uint32
+	Fields    map[string]string
+	Tags      map[string]string `json:",omitempty"`
+	RawPacket string            `json:",omitempty"`
+	Offset    int64
+	Length    int64
+	Warnings  []string `json:",omitempty"`
+	CRCValid  *bool    `json:",omitempty"`
+}
+
+// NewMeterReading converts msg to a MeterReading.
+func NewMeterReading(msg parse.LogMessage) (r MeterReading, err error) {
+	r = MeterReading{
+		Time:      msg.Time,
+		MsgType:   msg.MsgType(),
+		MeterID:   msg.MeterID(),
+		MeterType: uint32(msg.MeterType()),
+		Tags:      msg.Tags,
+		RawPacket: msg.RawPacket,
+		Offset:    msg.Offset,
+		Length:    int64(msg.Length),
+		Warnings:  msg.Warnings,
+		CRCValid:  msg.CRCValid,
+	}
+
+	data, err := json.Marshal(msg.Message)
+	if err != nil {
+		return r, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var value interface{}
+	if err := dec.Decode(&value); err != nil {
+		return r, err
+	}
+
+	r.Fields = make(map[string]string)
+	flatten(value, "", r.Fields)
+
+	return r, nil
+}
+
+// Adds the scalar values of v to fields keyed by their path.
+func flatten(v interface{}, key string, fields map[string]string) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for field, value := range v {
+			if key != "" {
+				field = key + "." + field
+			}
+			flatten(value, field, fields)
+		}
+	case []interface{}:
+		values := make([]string, len(v))
+		for idx, value := range v {
+			values[idx] = format(value)
+		}
+		fields[key] = strings.Join(values, ",")
+	default:
+		fields[key] = format(v)
+	}
+}
+
+// Formats a json value as a string.
+func format(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case bool:
+		return strconv.FormatBool(v)
+	case json.Number:
+		return v.String()
+	case string:
+		return v
+	}
+
+	// Nested arrays and objects in arrays.
+	data, _ := json.Marshal(value)
+	return string(data)
+}
+
+// Marshal returns the proto3 encoding of r. Map entries are written in key
+// order so the encoding is deterministic.
+func (r MeterReading) Marshal() []byte {
+	var buf []byte
+	if !r.Time.IsZero() {
+		buf = appendVarintField(buf, fieldTime, uint64(r.Time.UnixNano()))
+	}
+	buf = appendStringField(buf, fieldMsgType, r.MsgType)
+	if r.MeterID != 0 {
+		buf = appendVarintField(buf, fieldMeterID, uint64(r.MeterID))
+	}
+	if r.MeterType != 0 {
+		buf = appendVarintField(buf, fieldMeterType, uint64(r.MeterType))
+	}
+	buf = appendMapField(buf, fieldFields, r.Fields)
+	buf = appendMapField(buf, fieldTags, r.Tags)
+	buf = appendStringField(buf, fieldRawPacket, r.RawPacket)
+	if r.Offset != 0 {
+		buf = appendVarintField(buf, fieldOffset, uint64(r.Offset))
+	}
+	if r.Length != 0 {
+		buf = appendVarintField(buf, fieldLength, uint64(r.Length))
+	}
+	for _, warning := range r.Warnings {
+		buf = appendBytesField(buf, fieldWarnings, []byte(warning))
+	}
+	if r.CRCValid != nil {
+		var v uint64
+		if *r.CRCValid {
+			v = 1
+		}
+		buf = appendVarintField(buf, fieldCRCValid, v)
+	}
+	return buf
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	return append(buf, tmp[:binary.PutUvarint(tmp[:], v)]...)
+}
+
+func appendTag(buf []byte, field, wireType int) []byte {
+	return appendUvarint(buf, uint64(field<<3|wireType))
+}
+
+func appendVarintField(buf []byte, field int, v uint64) []byte {
+	buf = appendTag(buf, field, wireVarint)
+	return appendUvarint(buf, v)
+}
+
+func appendBytesField(buf []byte, field int, v []byte) []byte {
+	buf = appendTag(buf, field, wireBytes)
+	buf = appendUvarint(buf, uint64(len(v)))
+	return append(buf, v...)
+}
+
+// Empty strings are the proto3 default and aren't written.
+func appendStringField(buf []byte, field int, v string) []byte {
+	if v == "" {
+		return buf
+	}
+	return appendBytesField(buf, field, []byte(v))
+}
+
+// Map fields are repeated entry messages of key field 1 and value field 2.
+func appendMapField(buf []byte, field int, m map[string]string) []byte {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		var entry []byte
+		entry = appendBytesField(entry, 1, []byte(key))
+		entry = appendBytesField(entry, 2, []byte(m[key]))
+		buf = appendBytesField(buf, field, entry)
+	}
+	return buf
+}
+
+// Unmarshal decodes the proto3 encoding of a MeterReading into r. Unknown
+// fields are skipped.
+func (r *MeterReading) Unmarshal(data []byte) error {
+	*r = MeterReading{}
+
+	return walk(data, func(field int, v uint64, b []byte) (err error) {
+		switch field {
+		case fieldTime:
+			r.Time = time.Unix(0, int64(v)).UTC()
+		case fieldMsgType:
+			r.MsgType = string(b)
+		case fieldMeterID:
+			r.MeterID = uint32(v)
+		case fieldMeterType:
+			r.MeterType = uint32(v)
+		case fieldFields:
+			r.Fields, err = unmarshalEntry(r.Fields, b)
+		case fieldTags:
+			r.Tags, err = unmarshalEntry(r.Tags, b)
+		case fieldRawPacket:
+			r.RawPacket = string(b)
+		case fieldOffset:
+			r.Offset = int64(v)
+		case fieldLength:
+			r.Length = int64(v)
+		case fieldWarnings:
+			r.Warnings = append(r.Warnings, string(b))
+		case fieldCRCValid:
+			valid := v != 0
+			r.CRCValid = &valid
+		}
+		return
+	})
+}
+
+// Decodes a map entry of key field 1 and value field 2 into m, allocating it
+// if nil.
+func unmarshalEntry(m map[string]string, data []byte) (map[string]string, error) {
+	var key, value string
+	err := walk(data, func(field int, v uint64, b []byte) error {
+		switch field {
+		case 1:
+			key = string(b)
+		case 2:
+			value = string(b)
+		}
+		return nil
+	})
+	if err != nil {
+		return m, err
+	}
+
+	if m == nil {
+		m = make(map[string]string)
+	}
+	m[key] = value
+	return m, nil
+}
+
+// Calls fn with the number and value of each varint and length delimited
+// field of an encoded message. Fixed width fields are skipped.
+func walk(data []byte, fn func(field int, v uint64, b []byte) error) error {
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errors.New("protobuf: invalid tag")
+		}
+		data = data[n:]
+
+		field, wireType := int(tag>>3), int(tag&7)
+
+		var v uint64
+		var b []byte
+		switch wireType {
+		case wireVarint:
+			if v, n = binary.Uvarint(data); n <= 0 {
+				return fmt.Errorf("protobuf: invalid varint in field %d", field)
+			}
+			data = data[n:]
+		case wireBytes:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || length > uint64(len(data)-n) {
+				return fmt.Errorf("protobuf: invalid length in field %d", field)
+			}
+			b, data = data[n:n+int(length)], data[n+int(length):]
+		case wireFixed64, wireFixed32:
+			size := 8
+			if wireType == wireFixed32 {
+				size = 4
+			}
+			if len(data) < size {
+				return fmt.Errorf("protobuf: truncated field %d", field)
+			}
+			data = data[size:]
+			continue
+		default:
+			return fmt.Errorf("protobuf: unknown wire type %d in field %d", wireType, field)
+		}
+
+		if err := fn(field, v, b); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// An Encoder writes length-prefixed MeterReading messages to an output
+// stream.
+type Encoder struct {
+	w io.Writer
+}
+
+// NewEncoder returns a new encoder that writes to w.
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// Encode writes v, which must be a parse.LogMessage, as a length-prefixed
+// MeterReading.
+func (enc *Encoder) Encode(v interface{}) error {
+	msg, ok := v.(parse.LogMessage)
+	if !ok {
+		return fmt.Errorf("protobuf: can't encode %T", v)
+	}
+
+	r, err := NewMeterReading(msg)
+	if err != nil {
+		return err
+	}
+
+	data := r.Marshal()
+	buf := make([]byte, 4, 4+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(len(data)))
+	_, err = enc.w.Write(append(buf, data...))
+	return err
+}
+
+// A Decoder reads length-prefixed MeterReading messages from an input
+// stream.
+type Decoder struct {
+	r *bufio.Reader
+}
+
+// NewDecoder returns a new decoder that reads from r.
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: bufio.NewReader(r)}
+}
+
+// Decode reads the next MeterReading. Returns io.EOF at the end of the
+// stream, or io.ErrUnexpectedEOF if it ends mid message.
+func (dec *Decoder) Decode() (r MeterReading, err error) {
+	var length uint32
+	if err = binary.Read(dec.r, binary.BigEndian, &length); err != nil {
+		return
+	}
+	if length > MaxMessageLength {
+		return r, fmt.Errorf("protobuf: message length %d exceeds maximum %d", length, MaxMessageLength)
+	}
+
+	data := make([]byte, length)
+	if _, err = io.ReadFull(dec.r, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+
+	err = r.Unmarshal(data)
+	return
+}
@@ -0,0 +1,113 @@
+package protobuf
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bemasher/rtlamr/parse"
+	"github.com/bemasher/rtlamr/scm"
+)
+
+func TestMarshal(t *testing.T) {
+	valid := false
+	r := MeterReading{
+		MsgType:  "SCM",
+		MeterID:  300,
+		Tags:     map[string]string{"b": "2", "a": "1"},
+		Offset:   -1,
+		CRCValid: &valid,
+	}
+
+	expected := []byte{
+		0x12, 0x03, 'S', 'C', 'M', // msg_type
+		0x18, 0xAC, 0x02, // meter_id
+		0x32, 0x06, 0x0A, 0x01, 'a', 0x12, 0x01, '1', // tags
+		0x32, 0x06, 0x0A, 0x01, 'b', 0x12, 0x01, '2',
+		0x40, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0x01, // offset
+		0x58, 0x00, // crc_valid
+	}
+
+	if data := r.Marshal(); !bytes.Equal(data, expected) {
+		t.Errorf("expected % X, got % X", expected, data)
+	}
+}
+
+func TestEncodeDecode(t *testing.T) {
+	valid := true
+	msgs := []parse.LogMessage{
+		{
+			Time:     time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+			Offset:   1024,
+			Length:   512,
+			Message:  scm.SCM{ID: 12345678, Type: 7, Consumption: 1000, Checksum: 0xABCD},
+			Warnings: []string{"zero consumption"},
+			CRCValid: &valid,
+			Tags:     parse.Tags{"site": "north"},
+		},
+		{
+			Time:    time.Date(2024, 1, 1, 0, 0, 1, 0, time.UTC),
+			Message: scm.SCM{ID: 1, Type: 12},
+		},
+	}
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	for _, msg := range msgs {
+		if err := enc.Encode(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dec := NewDecoder(bytes.NewReader(buf.Bytes()))
+	for idx, msg := range msgs {
+		expected, err := NewMeterReading(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r, err := dec.Decode()
+		if err != nil {
+			t.Fatalf("message %d: %s", idx, err)
+		}
+		if !reflect.DeepEqual(r, expected) {
+			t.Errorf("message %d: expected %+v, got %+v", idx, expected, r)
+		}
+	}
+
+	if _, err := dec.Decode(); err != io.EOF {
+		t.Errorf("expected io.EOF, got %v", err)
+	}
+
+	dec = NewDecoder(bytes.NewReader(buf.Bytes()[:buf.Len()-1]))
+	dec.Decode()
+	if _, err := dec.Decode(); err != io.ErrUnexpectedEOF {
+		t.Errorf("expected io.ErrUnexpectedEOF, got %v", err)
+	}
+}
+
+func TestNewMeterReading(t *testing.T) {
+	r, err := NewMeterReading(parse.LogMessage{
+		Message: scm.SCM{ID: 12345678, Type: 7, Consumption: 1000},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"ID":          "12345678",
+		"Type":        "7",
+		"TamperPhy":   "0",
+		"TamperEnc":   "0",
+		"Consumption": "1000",
+		"Checksum":    "0",
+	}
+	if !reflect.DeepEqual(r.Fields, expected) {
+		t.Errorf("expected %v, got %v", expected, r.Fields)
+	}
+	if r.MsgType != "SCM" || r.MeterID != 12345678 || r.MeterType != 7 {
+		t.Errorf("unexpected reading: %+v", r)
+	}
+}
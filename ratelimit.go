@@ -0,0 +1,88 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2014 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// TokenBucket limits events to an average rate, allowing bursts of up to
+// burst events.
+type TokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	return &TokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Allow reports whether an event may happen now, consuming a token if so.
+func (tb *TokenBucket) Allow() bool {
+	now := time.Now()
+	tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+	if tb.tokens > tb.burst {
+		tb.tokens = tb.burst
+	}
+	tb.last = now
+
+	if tb.tokens < 1 {
+		return false
+	}
+
+	tb.tokens--
+	return true
+}
+
+// DropCounter counts messages dropped by a rate limit and logs how many at
+// most once per second. The first drop is logged immediately.
+type DropCounter struct {
+	dropped int
+	last    time.Time
+}
+
+// Add counts a dropped message.
+func (dc *DropCounter) Add() {
+	dc.dropped++
+	dc.Tick()
+}
+
+// Tick logs drops not yet reported if a second has passed since the last
+// log, so drops which stop are still reported. Call it periodically.
+func (dc *DropCounter) Tick() {
+	if time.Since(dc.last) >= time.Second {
+		dc.Flush()
+	}
+}
+
+// Flush logs drops not yet reported.
+func (dc *DropCounter) Flush() {
+	if dc.dropped == 0 {
+		return
+	}
+	log.Printf("Output rate limit exceeded, dropped %d messages\n", dc.dropped)
+	dc.dropped = 0
+	dc.last = time.Now()
+}
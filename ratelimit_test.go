@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketBurst(t *testing.T) {
+	tb := NewTokenBucket(1, 3)
+
+	for idx := 0; idx < 3; idx++ {
+		if !tb.Allow() {
+			t.Fatalf("expected event %d of the burst to be allowed", idx+1)
+		}
+	}
+	if tb.Allow() {
+		t.Error("expected event beyond the burst to be dropped")
+	}
+}
+
+func TestTokenBucketRefill(t *testing.T) {
+	tb := NewTokenBucket(2, 4)
+	for tb.Allow() {
+	}
+
+	// Half a second at 2 per second refills one token.
+	tb.last = tb.last.Add(-500 * time.Millisecond)
+	if !tb.Allow() {
+		t.Error("expected a refilled token to be allowed")
+	}
+	if tb.Allow() {
+		t.Error("expected only one token to be refilled")
+	}
+
+	// Refilling never exceeds the burst.
+	tb.last = tb.last.Add(-time.Hour)
+	allowed := 0
+	for tb.Allow() {
+		allowed++
+	}
+	if allowed != 4 {
+		t.Errorf("expected %d events after a long idle, got %d", 4, allowed)
+	}
+}
+
+func TestDropCounter(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	var dc DropCounter
+
+	// The first drop is reported immediately.
+	dc.Add()
+	if !strings.Contains(buf.String(), "dropped 1 messages") {
+		t.Errorf("expected the first drop to be logged, got %q", buf.String())
+	}
+
+	// Drops within a second are held back.
+	buf.Reset()
+	dc.Add()
+	dc.Add()
+	dc.Tick()
+	if buf.Len() != 0 {
+		t.Errorf("expected no log within a second, got %q", buf.String())
+	}
+
+	// Once a second has passed, drops which have stopped are reported.
+	dc.last = dc.last.Add(-time.Second)
+	dc.Tick()
+	if !strings.Contains(buf.String(), "dropped 2 messages") {
+		t.Errorf("expected held drops to be logged, got %q", buf.String())
+	}
+
+	// Nothing is logged without drops.
+	buf.Reset()
+	dc.Flush()
+	if buf.Len() != 0 {
+		t.Errorf("expected no log without drops, got %q", buf.String())
+	}
+}
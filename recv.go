@@ -17,25 +17,41 @@
 package main
 
 import (
-	"encoding/xml"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"math"
+	"net"
 	"os"
 	"os/signal"
 	"runtime/pprof"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/bemasher/rtlamr/decode"
 	"github.com/bemasher/rtlamr/idm"
 	"github.com/bemasher/rtlamr/parse"
 	"github.com/bemasher/rtlamr/scm"
+	"github.com/bemasher/rtlamr/session"
 	"github.com/bemasher/rtltcp"
 )
 
 const (
 	CenterFreq = 920299072
+
+	// Bounds of the 900MHz ISM band.
+	ISMLower = 902000000
+	ISMUpper = 928000000
+
+	// Time spent receiving at each candidate symbol length when detecting.
+	AutoDetectDuration = 30 * time.Second
 )
 
 var rcvr Receiver
@@ -47,29 +63,123 @@ type Receiver struct {
 }
 
 func (rcvr *Receiver) NewReceiver() {
-	switch strings.ToLower(*msgType) {
-	case "scm":
-		rcvr.d = decode.NewDecoder(scm.NewPacketConfig(*symbolLength), *fastMag)
-		rcvr.p = scm.NewParser()
-	case "idm":
-		rcvr.d = decode.NewDecoder(idm.NewPacketConfig(*symbolLength), *fastMag)
-		rcvr.p = idm.NewParser()
-	default:
-		log.Fatalf("Invalid message type: %q\n", *msgType)
+	if symbolLength.Auto {
+		if strings.ToLower(*msgType) != "scm" {
+			log.Fatal("Symbol length detection is only supported for scm")
+		}
+		if *listenAddr != "" {
+			log.Fatal("Symbol length detection sets the sample rate, it can't be used with -listen-addr")
+		}
+		if *replayFilename != "" {
+			log.Fatal("Symbol length detection sets the sample rate, it can't be used with -replay")
+		}
+		if *downsample > 1 {
+			log.Fatal("Symbol length detection can't be used with -downsample")
+		}
+		symbolLength.Length = scm.CandidateSymbolLengths[0]
 	}
 
-	if !*quiet {
+	rcvr.newDecoder(symbolLength.Length)
+
+	if !*quiet && !symbolLength.Auto {
 		rcvr.d.Cfg.Log()
 		log.Println("CRC:", rcvr.p)
 	}
 
-	// Connect to rtl_tcp server.
-	if err := rcvr.Connect(nil); err != nil {
-		log.Fatal(err)
+	// The preamble includes the sync word, there is no separate sync word.
+	if *printPreamble {
+		cfg := rcvr.d.Cfg
+		log.Printf("Preamble (%s): %s (0x%0*X), %d bits\n", rcvr.p.Type(), cfg.Preamble, (len(cfg.Preamble)+3)/4, cfg.PreambleValue(), len(cfg.Preamble))
+	}
+
+	// Samples pushed to us aren't from rtl_tcp, there's no dongle to
+	// configure.
+	if *listenAddr != "" {
+		if sessionWriter != nil {
+			log.Fatal("Sessions record an rtl_tcp connection, -record-session can't be used with -listen-addr")
+		}
+		rcvr.accept()
+
+		if *calibrateMeter != 0 {
+			calibrator = NewCalibrator(uint32(rcvr.Flags.CenterFreq))
+		}
+		rcvr.newNotch(int64(rcvr.Flags.CenterFreq))
+		return
+	}
+
+	// Neither are samples replayed from a file.
+	if *replayFilename != "" {
+		if sessionWriter != nil {
+			log.Fatal("Sessions record an rtl_tcp connection, -record-session can't be used with -replay")
+		}
+
+		offset := *skipBytes
+		if *skipDuration != 0 {
+			offset = skipDurationBytes(*skipDuration, rcvr.d.Cfg.SampleRate**downsample)
+		}
+		sampleReplay = openSampleReplay(*replayFilename, offset)
+
+		// Every rewind would hit the end of the file before filling a block.
+		if *replayLoop {
+			info, err := sampleReplay.Stat()
+			if err != nil {
+				log.Fatal("Error checking replay file: ", err)
+			}
+			if info.Size()-offset < int64(rcvr.d.Cfg.BlockSize2**downsample) {
+				log.Fatal("Replay file is shorter than a block of samples, it can't be looped")
+			}
+		}
+
+		if *calibrateMeter != 0 {
+			calibrator = NewCalibrator(uint32(rcvr.Flags.CenterFreq))
+		}
+		rcvr.newNotch(int64(rcvr.Flags.CenterFreq))
+		return
+	}
+
+	// Connect to rtl_tcp server, resolving its address ourselves if the
+	// address family is forced.
+	var addr *net.TCPAddr
+	if network := tcpNetwork(); network != "tcp" {
+		var err error
+		if addr, err = net.ResolveTCPAddr(network, rcvr.Flags.ServerAddr); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Connect has no timeout of its own, give up waiting on it after
+	// -conn-timeout.
+	connected := make(chan error, 1)
+	go func() {
+		connected <- rcvr.Connect(addr)
+	}()
+
+	connTimeoutCh := make(<-chan time.Time)
+	if *connTimeout != 0 {
+		connTimeoutCh = time.After(*connTimeout)
+	}
+
+	select {
+	case err := <-connected:
+		if err != nil {
+			log.Fatal(err)
+		}
+	case <-connTimeoutCh:
+		log.Fatalf("Error connecting to rtl_tcp at %s: connection timed out after %s\n", rcvr.Flags.ServerAddr, *connTimeout)
+	}
+	rcvr.configureConn()
+
+	// Bound commands sent while configuring the dongle.
+	if *networkTimeout != 0 {
+		rcvr.SetDeadline(time.Now().Add(*networkTimeout))
 	}
 
 	rcvr.HandleFlags()
 
+	if sessionWriter != nil {
+		rcvr.recordSession()
+	}
+
 	// Tell the user how many gain settings were reported by rtl_tcp.
 	if !*quiet {
 		log.Println("GainCount:", rcvr.SDR.Info.GainCount)
@@ -90,24 +200,345 @@ func (rcvr *Receiver) NewReceiver() {
 	})
 
 	// Set some parameters for listening.
-	if !centerfreqFlagSet {
-		rcvr.SetCenterFreq(uint32(rcvr.Flags.CenterFreq))
+	if !centerfreqFlagSet || *centerFreqOffset != 0 {
+		centerFreq := int64(rcvr.Flags.CenterFreq) + int64(*centerFreqOffset)
+		if *centerFreqOffset != 0 && (centerFreq < ISMLower || centerFreq > ISMUpper) {
+			log.Fatalf("Center frequency %d outside of %d-%d Hz ISM band\n", centerFreq, ISMLower, ISMUpper)
+		}
+
+		rcvr.SetCenterFreq(uint32(centerFreq))
+		recordCommand(session.SetCenterFreq, uint32(centerFreq))
+
+		if !*quiet {
+			log.Println("CenterFreq:", centerFreq)
+		}
+	}
+
+	if *calibrateMeter != 0 {
+		calibrator = NewCalibrator(uint32(int64(rcvr.Flags.CenterFreq) + int64(*centerFreqOffset)))
 	}
 
+	if symbolLength.Auto {
+		if sampleRateFlagSet {
+			log.Fatal("Symbol length detection sets the sample rate, -samplerate can't be given")
+		}
+
+		rcvr.newDecoder(rcvr.detectSymbolLength())
+
+		if !*quiet {
+			rcvr.d.Cfg.Log()
+			log.Println("CRC:", rcvr.p)
+		}
+	}
+
+	// Samples are received at a multiple of the decoder's sample rate when
+	// downsampling.
+	sampleRate := rcvr.d.Cfg.SampleRate * *downsample
 	if !sampleRateFlagSet {
-		rcvr.SetSampleRate(uint32(rcvr.d.Cfg.SampleRate))
+		rcvr.SetSampleRate(uint32(sampleRate))
+		recordCommand(session.SetSampleRate, uint32(sampleRate))
+	} else if !*sampleRateOverride {
+		// Warn if the user's sample rate differs from the decoder's by more
+		// than 1%.
+		need := float64(sampleRate)
+		set := float64(rcvr.Flags.SampleRate)
+		if math.Abs(set-need)/need > 0.01 {
+			log.Printf("sample rate mismatch: decoder needs %d, hardware set to %d; decoding may fail.\n",
+				sampleRate, rcvr.Flags.SampleRate,
+			)
+		}
 	}
 	if !gainFlagSet {
 		rcvr.SetGainMode(true)
+		recordCommand(session.SetGainMode, 1)
 	}
 
+	rcvr.newNotch(int64(rcvr.Flags.CenterFreq) + int64(*centerFreqOffset))
+
 	return
 }
 
-func (rcvr *Receiver) Run() {
-	// Setup signal channel for interruption.
-	sigint := make(chan os.Signal, 1)
-	signal.Notify(sigint, os.Kill, os.Interrupt)
+// Creates the -notch-freq filter for samples received at the given center
+// frequency.
+func (rcvr *Receiver) newNotch(centerFreq int64) {
+	if *notchFreq == 0 {
+		return
+	}
+
+	sampleRate := rcvr.d.Cfg.SampleRate * *downsample
+	offset := int64(*notchFreq) - centerFreq
+	if offset < -int64(sampleRate)/2 || offset > int64(sampleRate)/2 {
+		log.Fatalf("Notch frequency %d Hz outside of received band %d±%d Hz\n", *notchFreq, centerFreq, sampleRate/2)
+	}
+
+	notch = decode.NewNotch(float64(offset), *notchWidth, sampleRate)
+	if !*quiet {
+		log.Printf("Notch: %d Hz offset, %0.0f Hz wide\n", offset, *notchWidth)
+	}
+}
+
+// Builds the decoder and parser for the message type with the given symbol
+// length.
+func (rcvr *Receiver) newDecoder(symbolLength int) {
+	var opts []decode.Option
+	if *fastMag {
+		opts = append(opts, decode.WithFastMag())
+	}
+
+	// Check the symbol length before building the packet config, which
+	// panics on invalid lengths. Only the rate samples are received at must
+	// be one the dongle supports, the decoder may run at a decimated rate.
+	checkSymbolLength := func(dataRate int) {
+		if symbolLength <= 0 {
+			log.Fatal("Invalid symbol length: ", symbolLength)
+		}
+		if err := decode.CheckSymbolLength(symbolLength**downsample, dataRate); err != nil {
+			if *downsample > 1 {
+				log.Fatal("Invalid downsample factor: ", err)
+			}
+			log.Fatal("Invalid symbol length: ", err)
+		}
+	}
+
+	var cfg decode.PacketConfig
+	switch strings.ToLower(*msgType) {
+	case "scm":
+		checkSymbolLength(scm.DataRate)
+		cfg = scm.NewPacketConfig(symbolLength)
+		rcvr.p = scm.NewParser()
+	case "idm":
+		checkSymbolLength(idm.DataRate)
+		cfg = idm.NewPacketConfig(symbolLength)
+		rcvr.p = idm.NewParser()
+	default:
+		log.Fatalf("Invalid message type: %q\n", *msgType)
+	}
+
+	if *blockSize != 0 {
+		if err := cfg.SetBlockSize(*blockSize); err != nil {
+			log.Fatal("Invalid block size: ", err)
+		}
+	}
+
+	rcvr.d = decode.NewDecoder(cfg, opts...)
+}
+
+// Receives for AutoDetectDuration at the sample rate of each candidate symbol
+// length and returns the one which received the most packets.
+func (rcvr *Receiver) detectSymbolLength() int {
+	best, bestCount := 0, 0
+	for _, length := range scm.CandidateSymbolLengths {
+		sampleRate := length * scm.DataRate
+		rcvr.SetSampleRate(uint32(sampleRate))
+		recordCommand(session.SetSampleRate, uint32(sampleRate))
+
+		if *networkTimeout != 0 {
+			rcvr.SetDeadline(time.Now().Add(AutoDetectDuration + *networkTimeout))
+		}
+
+		size := int64(AutoDetectDuration.Seconds()*float64(sampleRate)) << 1
+		count, err := scm.CountPackets(io.LimitReader(rcvr, size), length)
+		if err != nil {
+			log.Fatal("Error detecting symbol length: ", err)
+		}
+
+		if !*quiet {
+			log.Printf("Symbol length %d: %d packets\n", length, count)
+		}
+
+		if count > bestCount {
+			best, bestCount = length, count
+		}
+	}
+
+	if bestCount == 0 {
+		log.Fatal("Error detecting symbol length: no packets received")
+	}
+
+	log.Println("Detected symbol length:", best)
+
+	return best
+}
+
+// Writes the IQ histogram to the file given by -iq-histogram.
+func (rcvr *Receiver) writeHistogram() {
+	if err := iqHistogram.WriteFile(*iqHistogramFilename); err != nil {
+		log.Println("Error writing IQ histogram:", err)
+	}
+}
+
+// Commands sent to rtl_tcp by the rtltcp package for each of its flags.
+var sessionCommands = map[string]uint8{
+	"centerfreq":     session.SetCenterFreq,
+	"samplerate":     session.SetSampleRate,
+	"tunergainmode":  session.SetGainMode,
+	"tunergain":      session.SetGain,
+	"freqcorrection": session.SetFreqCorrection,
+	"testmode":       session.SetTestMode,
+	"agcmode":        session.SetAGCMode,
+	"directsampling": session.SetDirectSampling,
+	"offsettuning":   session.SetOffsetTuning,
+	"rtlxtalfreq":    session.SetRTLXtalFreq,
+	"tunerxtalfreq":  session.SetTunerXtalFreq,
+	"gainbyindex":    session.SetGainByIndex,
+}
+
+// Records the dongle info and the commands sent by the rtltcp package for
+// any flags given on the command line.
+func (rcvr *Receiver) recordSession() {
+	var info bytes.Buffer
+	binary.Write(&info, binary.BigEndian, rcvr.SDR.Info)
+	if err := sessionWriter.WriteInfo(info.Bytes()); err != nil {
+		log.Fatal("Error writing session: ", err)
+	}
+
+	flag.Visit(func(f *flag.Flag) {
+		cmd, ok := sessionCommands[f.Name]
+		if !ok {
+			return
+		}
+
+		var param uint32
+		switch v := f.Value.String(); v {
+		case "true":
+			param = 1
+		case "false":
+			param = 0
+		default:
+			n, _ := strconv.ParseFloat(v, 64)
+			// Tuner gain is given in dB, rtl_tcp expects tenths of a dB.
+			if cmd == session.SetGain {
+				n *= 10
+			}
+			param = uint32(int32(n))
+		}
+
+		recordCommand(cmd, param)
+	})
+}
+
+// Waits for a single connection on -listen-addr and reads samples from it
+// instead of rtl_tcp. The source must stream samples at the decoder's sample
+// rate without rtl_tcp's dongle info header.
+func (rcvr *Receiver) accept() {
+	l, err := net.Listen(tcpNetwork(), *listenAddr)
+	if err != nil {
+		log.Fatal("Error listening for samples: ", err)
+	}
+	defer l.Close()
+
+	if !*quiet {
+		log.Printf("Waiting for samples at %d Hz on %s\n", rcvr.d.Cfg.SampleRate**downsample, l.Addr())
+	}
+
+	conn, err := l.(*net.TCPListener).AcceptTCP()
+	if err != nil {
+		log.Fatal("Error accepting sample connection: ", err)
+	}
+	rcvr.TCPConn = conn
+	rcvr.configureConn()
+
+	if !*quiet {
+		log.Println("Receiving samples from", conn.RemoteAddr())
+	}
+}
+
+// Sets -tcp-nodelay, -keepalive and the receive buffer size given by
+// -network-buffer-size on the sample connection, logging the buffer size
+// granted by the OS.
+func (rcvr *Receiver) configureConn() {
+	if err := rcvr.SetNoDelay(*tcpNoDelay); err != nil {
+		log.Fatal("Error setting tcp no delay: ", err)
+	}
+
+	if err := rcvr.SetKeepAlive(*keepAlive != 0); err != nil {
+		log.Fatal("Error setting tcp keepalive: ", err)
+	}
+	if *keepAlive != 0 {
+		if err := rcvr.SetKeepAlivePeriod(*keepAlive); err != nil {
+			log.Fatal("Error setting tcp keepalive period: ", err)
+		}
+		if !*quiet {
+			log.Println("TCP keepalive:", *keepAlive)
+		}
+	}
+
+	if *networkBufferSize == 0 {
+		return
+	}
+
+	if err := rcvr.SetReadBuffer(*networkBufferSize); err != nil {
+		log.Fatal("Error setting network buffer size: ", err)
+	}
+
+	if !*quiet {
+		size, err := receiveBufferSize(rcvr.TCPConn)
+		if err != nil {
+			log.Println("Error reading network buffer size:", err)
+			return
+		}
+		log.Printf("Network buffer size: %d bytes requested, %d granted\n", *networkBufferSize, size)
+	}
+}
+
+// Returns the network to connect or listen on, forced to IPv4 or IPv6 by
+// -ipv4 or -ipv6.
+func tcpNetwork() string {
+	switch {
+	case *ipv4:
+		return "tcp4"
+	case *ipv6:
+		return "tcp6"
+	}
+	return "tcp"
+}
+
+// Records a command sent to rtl_tcp if a session is being recorded.
+func recordCommand(cmd uint8, param uint32) {
+	if sessionWriter == nil {
+		return
+	}
+
+	if err := sessionWriter.WriteCommand(cmd, param); err != nil {
+		log.Fatal("Error writing session: ", err)
+	}
+}
+
+// Reports whether msg passes the -filterid and -filtertype filters, empty
+// filters pass every message.
+func matchesMeterFilter(msg parse.Message) bool {
+	if len(meterID) > 0 || len(meterIDRanges) > 0 {
+		id := uint(msg.MeterID())
+		if !meterID[id] && !meterIDRanges.Contains(id) {
+			return false
+		}
+	}
+
+	if len(meterType) > 0 && !meterType[uint(msg.MeterType())] {
+		return false
+	}
+
+	return true
+}
+
+// Returns r read through a buffer of the given size, or r itself if size is
+// 0, so blocks smaller than the buffer are filled with fewer reads.
+func newSampleReader(r io.Reader, size int) io.Reader {
+	if size == 0 {
+		return r
+	}
+	return bufio.NewReaderSize(r, size)
+}
+
+// Run receives until ctx is cancelled, the time limit is reached, a single
+// message is received if -single is given or -count messages are received.
+// Returns the number of messages received which matched all filters, and
+// the error which ended the run if samples couldn't be read or
+// -exit-on-max-parse-errors was reached.
+func (rcvr *Receiver) Run(ctx context.Context) (received int, err error) {
+	// Stop the sample reader however we return.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
 	// Setup time limit channel
 	tLimit := make(<-chan time.Time, 1)
@@ -115,83 +546,299 @@ func (rcvr *Receiver) Run() {
 		tLimit = time.After(*timeLimit)
 	}
 
-	block := make([]byte, rcvr.d.Cfg.BlockSize2)
+	// Read sample blocks in a separate goroutine so the decoder doesn't
+	// block reads from rtl_tcp. Blocks are recycled through the free channel
+	// once decoded.
+	blocks := make(chan []byte, *channelBuf)
+	readErr := make(chan error, 1)
+	free := make(chan []byte, *channelBuf+2)
+	for idx := 0; idx < cap(free); idx++ {
+		free <- make([]byte, rcvr.d.Cfg.BlockSize2)
+	}
+
+	// Blocks are read into raw and decimated when downsampling.
+	var raw []byte
+	if *downsample > 1 {
+		raw = make([]byte, rcvr.d.Cfg.BlockSize2**downsample)
+	}
+
+	// The reader may outlive Run, it keeps its own copy of the replay state.
+	replay, loop := sampleReplay, *replayLoop
+
+	var source io.Reader = rcvr
+	if replay != nil {
+		source = replay
+	}
+	samples := newSampleReader(source, *readBufferSize)
+
+	go func() {
+		for {
+			var block []byte
+			select {
+			case <-ctx.Done():
+				return
+			case block = <-free:
+			}
+
+			if *networkTimeout != 0 && replay == nil {
+				rcvr.SetDeadline(time.Now().Add(*networkTimeout))
+			}
+
+			buf := block
+			if raw != nil {
+				buf = raw
+			}
+
+			_, err := io.ReadFull(samples, buf)
+			// A looped replay starts over, the partial block is dropped.
+			for loop && (err == io.EOF || err == io.ErrUnexpectedEOF) {
+				if _, err = replay.Seek(sampleReplayOffset, io.SeekStart); err != nil {
+					break
+				}
+				atomic.AddUint64(&replayLoops, 1)
+				_, err = io.ReadFull(samples, buf)
+			}
+			if err != nil {
+				// The connection may be closed once we're done.
+				if ctx.Err() != nil {
+					return
+				}
+				// A replayed file has run out, a partial block is dropped.
+				if replay != nil && (err == io.EOF || err == io.ErrUnexpectedEOF) {
+					close(blocks)
+					return
+				}
+				readErr <- fmt.Errorf("error reading samples: %s", err)
+				return
+			}
+			if sessionWriter != nil {
+				if err := sessionWriter.WriteSamples(buf); err != nil {
+					readErr <- fmt.Errorf("error writing session: %s", err)
+					return
+				}
+			}
+			if notch != nil {
+				notch.Execute(buf)
+			}
+			if raw != nil {
+				decode.Decimate(raw, block, *downsample)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case blocks <- block:
+			}
+		}
+	}()
+
+	// Setup output flush interval channel
+	flushTick := make(<-chan time.Time, 1)
+	if outputBuf != nil && *outputFlushInterval != 0 {
+		ticker := time.NewTicker(*outputFlushInterval)
+		defer ticker.Stop()
+		flushTick = ticker.C
+	}
+
+	// Write any buffered output and close outputs before returning.
+	handler := NewMessageHandler()
+	defer handler.Close()
+	defer func() { received = handler.received }()
+
+	// Setup idle split file check channel
+	idleTick := make(<-chan time.Time, 1)
+	if splitWriter != nil {
+		if *splitIdleClose != 0 {
+			ticker := time.NewTicker(*splitIdleClose)
+			defer ticker.Stop()
+			idleTick = ticker.C
+		}
+	}
+
+	// Setup heap limit channel
+	memoryExceeded := make(<-chan uint64, 1)
+	if *maxMemory != 0 {
+		memoryExceeded = watchMemory(ctx, uint64(*maxMemory)<<20, time.Second)
+	}
+
+	// Setup output rate limit warning channel
+	dropTick := make(<-chan time.Time, 1)
+	if outputLimiter != nil {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		dropTick = ticker.C
+	}
+
+	// Setup stats interval channel
+	statsTick := make(<-chan time.Time, 1)
+	if *statsInterval != 0 {
+		ticker := time.NewTicker(*statsInterval)
+		defer ticker.Stop()
+		statsTick = ticker.C
+	}
+
+	// Setup IQ histogram signal channel
+	histogramSignal := make(chan os.Signal, 1)
+	if iqHistogram != nil {
+		defer rcvr.writeHistogram()
+		if len(histogramSignals) > 0 {
+			signal.Notify(histogramSignal, histogramSignals...)
+			defer signal.Stop(histogramSignal)
+		}
+	}
+
+	// Consecutive packets which failed to parse.
+	parseErrors := 0
 
 	start := time.Now()
 	for {
 		// Exit on interrupt or time limit, otherwise receive.
 		select {
-		case <-sigint:
+		case <-ctx.Done():
 			return
 		case <-tLimit:
 			fmt.Println("Time Limit Reached:", time.Since(start))
 			return
-		default:
-			// Read new sample block.
-			_, err := rcvr.Read(block)
-			if err != nil {
-				log.Fatal("Error reading samples: ", err)
+		case <-statsTick:
+			line := fmt.Sprintf("Stats (%s): %+v", rcvr.p.Type(), rcvr.d.Stats())
+			if *stripZeroConsumption {
+				line += fmt.Sprintf(" Stripped:%d", handler.stripped)
+			}
+			if *strictMeterType {
+				line += fmt.Sprintf(" UnknownMeterTypes:%v", handler.unknownTypes)
+			}
+			line += fmt.Sprintf(" QueueDepth:%d/%d", len(blocks), cap(blocks))
+			for _, sink := range sinks {
+				if bs, ok := sink.(*BreakerSink); ok {
+					line += fmt.Sprintf(" Output(%s):{Errors:%d Dropped:%d}", bs.Sink, bs.Errors, bs.Dropped)
+				}
+			}
+			if *replayLoop {
+				line += fmt.Sprintf(" ReplayLoops:%d", atomic.LoadUint64(&replayLoops))
+			}
+			log.Println(line)
+		case <-dropTick:
+			handler.dropped.Tick()
+		case <-histogramSignal:
+			rcvr.writeHistogram()
+		case heap := <-memoryExceeded:
+			if !relieveMemory(heap, uint64(*maxMemory)<<20) {
+				return
+			}
+			handler.buffered = 0
+		case <-flushTick:
+			handler.Flush()
+		case err = <-readErr:
+			return
+		case <-idleTick:
+			if err := splitWriter.CloseIdle(*splitIdleClose); err != nil {
+				log.Fatal("Error closing split file: ", err)
+			}
+		case block, ok := <-blocks:
+			if !ok {
+				return
+			}
+
+			if iqHistogram != nil {
+				iqHistogram.Add(block)
 			}
 
 			pktFound := false
 			for _, pkt := range rcvr.d.Decode(block) {
-				scm, err := rcvr.p.Parse(parse.NewDataFromBytes(pkt))
+				data := parse.NewDataFromBytes(pkt)
+				scm, err := rcvr.p.Parse(data)
 				if err != nil {
-					// log.Println(err)
-					continue
+					if *logCRCFailures {
+						// Stats include the current block.
+						offset := rcvr.d.Stats().BytesConsumed - uint64(len(block))
+						log.Printf("Parse failed at block offset %d: %s: %02X\n", offset, err, pkt)
+					}
+					rcvr.d.AddCRCFailure()
+
+					parseErrors++
+					if parseErrors == *maxParseErrors {
+						log.Printf("%d consecutive parse failures, possible message type mismatch or hardware issue\n", parseErrors)
+						if *exitOnMaxParseErrors {
+							return received, fmt.Errorf("exiting on %d consecutive parse failures", parseErrors)
+						}
+					}
+				} else {
+					parseErrors = 0
 				}
 
-				if len(meterID) > 0 && !meterID[uint(scm.MeterID())] {
+				crcValid := err == nil
+				if _, ok := err.(parse.CRCError); ok && *noCRCFilter {
+					if up, ok := rcvr.p.(parse.UncheckedParser); ok {
+						scm, err = up.ParseUnchecked(data)
+					}
+				}
+				if err != nil {
 					continue
 				}
 
-				if len(meterType) > 0 && !meterType[uint(scm.MeterType())] {
+				if calibrator != nil {
+					if uint(scm.MeterID()) != *calibrateMeter {
+						continue
+					}
+
+					offset, ok := rcvr.d.FreqOffset(pkt)
+					if !ok {
+						continue
+					}
+					log.Printf("Calibration packet %d: %0.0f Hz\n", len(calibrator.offsets)+1, offset)
+
+					if calibrator.Add(offset) {
+						fmt.Printf("Frequency Offset: %0.0f Hz\n", calibrator.Offset())
+						fmt.Printf("Frequency Correction: %0.1f ppm\n", calibrator.PPM())
+						return received, nil
+					}
 					continue
 				}
 
+				if *minSNR != 0 {
+					if snr, ok := rcvr.d.SNR(pkt); ok && snr < *minSNR {
+						rcvr.d.AddLowSNR()
+						continue
+					}
+				}
+
 				var msg parse.LogMessage
 				msg.Time = time.Now()
 				msg.Offset, _ = sampleFile.Seek(0, os.SEEK_CUR)
 				msg.Length = rcvr.d.Cfg.BufferLength << 1
 				msg.Message = scm
 
-				if encoder == nil {
-					// A nil encoder is just plain-text output.
-					if *sampleFilename == os.DevNull {
-						fmt.Fprintln(logFile, msg.StringNoOffset())
-					} else {
-						fmt.Fprintln(logFile, msg)
-					}
-				} else {
-					err = encoder.Encode(msg)
-					if err != nil {
-						log.Fatal("Error encoding message: ", err)
-					}
+				if *includeRaw {
+					msg.RawPacket = fmt.Sprintf("%02X", pkt)
+				}
 
-					// The XML encoder doesn't write new lines after each
-					// element, add them.
-					if _, ok := encoder.(*xml.Encoder); ok {
-						fmt.Fprintln(logFile)
-					}
+				if *noCRCFilter {
+					msg.CRCValid = &crcValid
+				}
+
+				if !handler.Handle(msg) {
+					continue
 				}
 
 				pktFound = true
-				if *single {
+				if handler.Done() {
 					break
 				}
 			}
 
 			if pktFound {
 				if *sampleFilename != os.DevNull {
-					_, err = sampleFile.Write(rcvr.d.IQ)
+					_, err := sampleFile.Write(rcvr.d.IQ)
 					if err != nil {
 						log.Fatal("Error writing raw samples to file:", err)
 					}
 				}
-				if *single {
+				if handler.Done() {
 					return
 				}
 			}
+
+			free <- block
 		}
 	}
 }
@@ -203,17 +850,61 @@ func init() {
 var cpuprofile = flag.String("cpuprofile", "", "write cpu profile to this file")
 
 func main() {
+	// Exit with a status code once everything else is cleaned up.
+	exitCode := 0
+	defer func() {
+		if exitCode != 0 {
+			os.Exit(exitCode)
+		}
+	}()
+
 	rcvr.RegisterFlags()
 	RegisterFlags()
 
 	flag.Parse()
 	HandleFlags()
 
+	if *replayFilename != "" && strings.ToLower(*inputFormat) == "json" {
+		defer logFile.Close()
+		if gzipWriter != nil {
+			defer gzipWriter.Close()
+		}
+
+		if replayMessages(*replayFilename) == 0 {
+			exitCode = *exitCodeNoData
+		}
+		return
+	}
+
 	rcvr.NewReceiver()
 
+	if *verboseStartup {
+		LogFlags()
+	}
+
+	if *checkSDR {
+		rcvr.checkSDR()
+		return
+	}
+
+	if *gainSweep {
+		rcvr.gainSweep()
+	}
+
 	defer logFile.Close()
+	if gzipWriter != nil {
+		// Write the gzip footer before the file is closed.
+		defer gzipWriter.Close()
+	}
 	defer sampleFile.Close()
-	defer rcvr.Close()
+	if sessionFile != nil {
+		defer sessionFile.Close()
+	}
+	if sampleReplay != nil {
+		defer sampleReplay.Close()
+	} else {
+		defer rcvr.Close()
+	}
 
 	if *cpuprofile != "" {
 		f, err := os.Create(*cpuprofile)
@@ -224,5 +915,40 @@ func main() {
 		defer pprof.StopCPUProfile()
 	}
 
-	rcvr.Run()
+	// Setup signal channel for interruption.
+	ctx, cancel := context.WithCancel(context.Background())
+	sigint := make(chan os.Signal, 1)
+	signal.Notify(sigint, os.Kill, os.Interrupt)
+	go func() {
+		<-sigint
+		cancel()
+	}()
+
+	if *signalReport {
+		rcvr.reportSignal(ctx, *signalReportInterval)
+		return
+	}
+
+	if *preRunCmd != "" {
+		if err := runCommand(*preRunCmd); err != nil {
+			log.Fatal("Error running pre-run command: ", err)
+		}
+	}
+
+	received, err := rcvr.Run(ctx)
+
+	if *postRunCmd != "" {
+		if err := runCommand(*postRunCmd); err != nil {
+			log.Println("Error running post-run command:", err)
+		}
+	}
+
+	if err != nil {
+		log.Println(err)
+		exitCode = 1
+		return
+	}
+	if received == 0 {
+		exitCode = *exitCodeNoData
+	}
 }
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/bemasher/rtlamr/decode"
+	"github.com/bemasher/rtlamr/scm"
+)
+
+// Serves an rtl_tcp dongle info header followed by silence until the client
+// disconnects.
+func mockRTLTCP(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		info := []byte{'R', 'T', 'L', '0', 0, 0, 0, 5, 0, 0, 0, 29}
+		if _, err := conn.Write(info); err != nil {
+			return
+		}
+
+		block := make([]byte, 16384)
+		for idx := range block {
+			block[idx] = 127
+		}
+		for {
+			if _, err := conn.Write(block); err != nil {
+				return
+			}
+		}
+	}()
+
+	return l
+}
+
+func TestReceiverRunCancellation(t *testing.T) {
+	goroutines := runtime.NumGoroutine()
+
+	l := mockRTLTCP(t)
+	defer l.Close()
+
+	var rcvr Receiver
+	rcvr.d = decode.NewDecoder(scm.NewPacketConfig(73))
+	rcvr.p = scm.NewParser()
+
+	if err := rcvr.Connect(l.Addr().(*net.TCPAddr)); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		rcvr.Run(ctx)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("Run did not return within 500ms of cancellation")
+	}
+
+	rcvr.Close()
+	l.Close()
+
+	// Give the reader and mock server a moment to exit.
+	deadline := time.Now().Add(500 * time.Millisecond)
+	for runtime.NumGoroutine() > goroutines && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > goroutines {
+		t.Fatalf("leaked %d goroutines", n-goroutines)
+	}
+}
+
+func TestUintMapSet(t *testing.T) {
+	testCases := []struct {
+		name     string
+		value    string
+		expected UintMap
+		err      bool
+	}{
+		{"Empty", "", UintMap{}, true},
+		{"Single", "12345678", UintMap{12345678: true}, false},
+		{"List", "1,2,3", UintMap{1: true, 2: true, 3: true}, false},
+		{"Duplicate", "1,1", UintMap{1: true}, false},
+		{"Max", "18446744073709551615", UintMap{18446744073709551615: true}, false},
+		{"Overflow", "18446744073709551616", UintMap{}, true},
+		{"Negative", "-1", UintMap{}, true},
+		{"TrailingComma", "1,", UintMap{1: true}, true},
+		{"NotNumber", "abc", UintMap{}, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			m := make(UintMap)
+
+			fs := flag.NewFlagSet("rtlamr", flag.ContinueOnError)
+			fs.SetOutput(ioutil.Discard)
+			fs.Var(m, "filterid", "")
+
+			err := fs.Parse([]string{"-filterid=" + tc.value})
+			if (err != nil) != tc.err {
+				t.Fatalf("expected error %v, got %v", tc.err, err)
+			}
+			if !reflect.DeepEqual(m, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, m)
+			}
+		})
+	}
+}
+
+func TestMeterIDFilter(t *testing.T) {
+	defer func(id, typ UintMap) {
+		meterID, meterType = id, typ
+	}(meterID, meterType)
+
+	testCases := []struct {
+		name     string
+		id, typ  UintMap
+		msg      scm.SCM
+		expected bool
+	}{
+		{"NoFilter", UintMap{}, UintMap{}, scm.SCM{ID: 1, Type: 7}, true},
+		{"IDMatch", UintMap{1: true, 2: true}, UintMap{}, scm.SCM{ID: 2, Type: 7}, true},
+		{"IDMismatch", UintMap{1: true}, UintMap{}, scm.SCM{ID: 3, Type: 7}, false},
+		{"TypeMatch", UintMap{}, UintMap{7: true}, scm.SCM{ID: 3, Type: 7}, true},
+		{"TypeMismatch", UintMap{}, UintMap{8: true}, scm.SCM{ID: 3, Type: 7}, false},
+		{"BothMatch", UintMap{3: true}, UintMap{7: true}, scm.SCM{ID: 3, Type: 7}, true},
+		{"TypeOnlyMatch", UintMap{1: true}, UintMap{7: true}, scm.SCM{ID: 3, Type: 7}, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			meterID, meterType = tc.id, tc.typ
+
+			if got := matchesMeterFilter(tc.msg); got != tc.expected {
+				t.Errorf("expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestUintRangesReadFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "rtlamr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("# meters\n\n5\n1000-1999\n1500-2500\n2501\n0-4294967295\n")
+	f.Close()
+
+	var r UintRanges
+	if err := r.ReadFile(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The full range swallows the others without expanding.
+	if expected := (UintRanges{{0, 4294967295}}); !reflect.DeepEqual(r, expected) {
+		t.Errorf("expected %v, got %v", expected, r)
+	}
+
+	r = UintRanges{{5, 5}, {1000, 1999}, {1500, 2500}, {2501, 2501}, {3000, 3000}}
+	r.merge()
+	if expected := (UintRanges{{5, 5}, {1000, 2501}, {3000, 3000}}); !reflect.DeepEqual(r, expected) {
+		t.Errorf("expected %v, got %v", expected, r)
+	}
+
+	for _, tc := range []struct {
+		n        uint
+		expected bool
+	}{
+		{4, false}, {5, true}, {6, false}, {999, false}, {1000, true},
+		{2000, true}, {2501, true}, {2502, false}, {3000, true}, {3001, false},
+	} {
+		if got := r.Contains(tc.n); got != tc.expected {
+			t.Errorf("%d: expected %v, got %v", tc.n, tc.expected, got)
+		}
+	}
+
+	// Ids from -filterid-file are combined with those from -filterid.
+	defer func(id UintMap, ranges UintRanges) {
+		meterID, meterIDRanges = id, ranges
+	}(meterID, meterIDRanges)
+	meterID, meterIDRanges = UintMap{7: true}, r
+	for _, tc := range []struct {
+		id       uint32
+		expected bool
+	}{{7, true}, {2000, true}, {8, false}} {
+		if got := matchesMeterFilter(scm.SCM{ID: tc.id}); got != tc.expected {
+			t.Errorf("filter %d: expected %v, got %v", tc.id, tc.expected, got)
+		}
+	}
+}
+
+// Reads small blocks of samples from a loopback rtl_tcp stand-in, directly
+// and through a read buffer.
+func BenchmarkSampleReader(b *testing.B) {
+	const blockSize = 1024
+
+	for _, size := range []int{0, 1 << 16} {
+		b.Run(fmt.Sprintf("ReadBufferSize=%d", size), func(b *testing.B) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer l.Close()
+
+			go func() {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+
+				chunk := make([]byte, 1<<14)
+				for {
+					if _, err := conn.Write(chunk); err != nil {
+						return
+					}
+				}
+			}()
+
+			conn, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer conn.Close()
+
+			r := newSampleReader(conn, size)
+			block := make([]byte, blockSize)
+
+			b.SetBytes(blockSize)
+			b.ResetTimer()
+			for idx := 0; idx < b.N; idx++ {
+				if _, err := io.ReadFull(r, block); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,174 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2014 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bemasher/rtlamr/idm"
+	"github.com/bemasher/rtlamr/parse"
+	"github.com/bemasher/rtlamr/scm"
+)
+
+// Longest line of json accepted by -replay.
+const MaxReplayLineLength = 1 << 20
+
+// A message as written by -format=json. Fields unknown to this version are
+// ignored and missing fields are left zero.
+type replayMessage struct {
+	parse.LogMessage
+	Message json.RawMessage
+}
+
+// Decodes the json encoding of a message of the given type.
+func decodeMessage(msgType string, data []byte) (msg parse.Message, err error) {
+	if len(data) == 0 || string(data) == "null" {
+		return nil, errors.New("no message")
+	}
+
+	switch msgType {
+	case "scm":
+		var m scm.SCM
+		err = json.Unmarshal(data, &m)
+		msg = m
+	case "idm":
+		var m idm.IDM
+		err = json.Unmarshal(data, &m)
+		msg = m
+	default:
+		err = fmt.Errorf("invalid message type: %q", msgType)
+	}
+	return
+}
+
+// Reads messages of -msgtype written by a previous run with -format=json
+// from the named file, or stdin if "-", and writes those passing the current
+// filters with the current output settings. Returns the number of messages
+// written.
+func replayMessages(filename string) int {
+	var r io.Reader = os.Stdin
+	if filename != "-" {
+		f, err := os.Open(filename)
+		if err != nil {
+			log.Fatal("Error opening replay file: ", err)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	handler := NewMessageHandler()
+	defer handler.Close()
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, MaxReplayLineLength)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var rm replayMessage
+		if err := json.Unmarshal(scanner.Bytes(), &rm); err != nil {
+			log.Printf("Skipping replay line %d: %s\n", lineNum, err)
+			continue
+		}
+
+		var err error
+		msg := rm.LogMessage
+		if msg.Message, err = decodeMessage(strings.ToLower(*msgType), rm.Message); err != nil {
+			log.Printf("Skipping replay line %d: %s\n", lineNum, err)
+			continue
+		}
+
+		if handler.Handle(msg) && handler.Done() {
+			break
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		log.Fatal("Error reading replay file: ", err)
+	}
+
+	return handler.received
+}
+
+// Samples read by -replay with -input-format=iq, nil otherwise.
+var sampleReplay *os.File
+
+// Offset of the first sample replayed, -replay-loop rewinds to it.
+var sampleReplayOffset int64
+
+// Times -replay-loop has rewound the replay file, updated atomically.
+var replayLoops uint64
+
+// Opens the named file of raw samples, or stdin if "-", for -replay with
+// -input-format=iq and skips the first offset bytes of it.
+func openSampleReplay(filename string, offset int64) *os.File {
+	f := os.Stdin
+	if filename != "-" {
+		var err error
+		f, err = os.Open(filename)
+		if err != nil {
+			log.Fatal("Error opening replay file: ", err)
+		}
+	}
+
+	if err := skipSamples(f, offset); err != nil {
+		log.Fatal("Error skipping samples: ", err)
+	}
+	sampleReplayOffset = offset
+
+	return f
+}
+
+// Skips the first offset bytes of f. Regular files are seeked, anything else
+// such as a pipe is read and discarded.
+func skipSamples(f *os.File, offset int64) error {
+	if offset == 0 {
+		return nil
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if !info.Mode().IsRegular() {
+		_, err := io.CopyN(ioutil.Discard, f, offset)
+		return err
+	}
+
+	if offset > info.Size() {
+		return fmt.Errorf("offset %d is beyond the end of %s (%d bytes)", offset, f.Name(), info.Size())
+	}
+	_, err = f.Seek(offset, io.SeekStart)
+	return err
+}
+
+// Number of bytes of interleaved 8-bit I/Q samples received in d at
+// sampleRate, always even so the skip lands on a sample boundary.
+func skipDurationBytes(d time.Duration, sampleRate int) int64 {
+	return int64(d.Seconds()*float64(sampleRate)) * 2
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bemasher/rtlamr/decode"
+	"github.com/bemasher/rtlamr/internal/testutil"
+	"github.com/bemasher/rtlamr/scm"
+)
+
+func TestDecodeMessage(t *testing.T) {
+	data := []byte(`{"ID":10000001,"Type":7,"Consumption":1234567,"Checksum":16571,"Unknown":"ignored"}`)
+
+	msg, err := decodeMessage("scm", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := scm.SCM{ID: 10000001, Type: 7, Consumption: 1234567, Checksum: 16571}
+	if msg != expected {
+		t.Errorf("expected %+v, got %+v", expected, msg)
+	}
+
+	for _, data := range []string{"", "null", `{"ID":"not a number"}`} {
+		if _, err := decodeMessage("scm", []byte(data)); err == nil {
+			t.Errorf("expected error decoding %q", data)
+		}
+	}
+
+	if _, err := decodeMessage("unknown", data); err == nil {
+		t.Error("expected error for unknown message type")
+	}
+}
+
+func TestSkipSamples(t *testing.T) {
+	f, err := ioutil.TempFile("", "rtlamr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if _, err := f.Write([]byte{0, 1, 2, 3, 4, 5, 6, 7}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := skipSamples(f, 6); err != nil {
+		t.Fatal(err)
+	}
+	rest, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rest) != string([]byte{6, 7}) {
+		t.Errorf("expected [6 7] after skipping, got %v", rest)
+	}
+
+	if err := skipSamples(f, 10); err == nil {
+		t.Error("expected error skipping beyond the end of the file")
+	}
+}
+
+func TestSkipDurationBytes(t *testing.T) {
+	for _, tc := range []struct {
+		d          time.Duration
+		sampleRate int
+		expected   int64
+	}{
+		{0, 2359296, 0},
+		{time.Second, 2359296, 4718592},
+		{10 * time.Millisecond, 2359296, 47184},
+		{time.Microsecond, 2359296, 4},
+	} {
+		if got := skipDurationBytes(tc.d, tc.sampleRate); got != tc.expected {
+			t.Errorf("%s at %d: expected %d, got %d", tc.d, tc.sampleRate, tc.expected, got)
+		}
+	}
+}
+
+func TestReplayMessages(t *testing.T) {
+	lines := []string{
+		`{"Time":"2017-07-14T02:40:00Z","Offset":0,"Length":0,"Message":{"ID":1,"Type":7,"Consumption":100,"Checksum":0},"crc_valid":true}`,
+		`not json`,
+		`{"Time":"2017-07-14T02:40:01Z","Offset":0,"Length":0,"Message":{"ID":2,"Type":7,"Consumption":200,"Checksum":0}}`,
+		``,
+		`{"Time":"2017-07-14T02:40:02Z","Offset":0,"Length":0,"Message":{"ID":1,"Type":7,"Consumption":0,"Checksum":0}}`,
+		`{"Time":"2017-07-14T02:40:03Z","Offset":0,"Length":0,"Message":{"ID":3,"Type":7,"Consumption":300,"Checksum":0}}`,
+	}
+
+	f, err := ioutil.TempFile("", "rtlamr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	for _, line := range lines {
+		f.WriteString(line + "\n")
+	}
+	f.Close()
+
+	var buf bytes.Buffer
+	output, encoder, meterID = &buf, NewEncoder("json", &buf), UintMap{1: true, 2: true}
+	*stripZeroConsumption = true
+	defer func() {
+		output, encoder, meterID = nil, nil, nil
+		*stripZeroConsumption = false
+	}()
+
+	// Meter 3 is filtered, meter 1's zero reading is stripped and the bad
+	// lines are skipped.
+	if received := replayMessages(f.Name()); received != 2 {
+		t.Fatalf("expected 2 messages, got %d", received)
+	}
+
+	var ids []uint32
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var rm replayMessage
+		if err := json.Unmarshal(scanner.Bytes(), &rm); err != nil {
+			t.Fatal(err)
+		}
+		var msg scm.SCM
+		if err := json.Unmarshal(rm.Message, &msg); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, msg.ID)
+
+		// Checksum validity is only kept with -no-crc-filter.
+		if rm.CRCValid != nil {
+			t.Errorf("expected crc_valid to be dropped, got %v", *rm.CRCValid)
+		}
+		if rm.Time.Before(time.Date(2017, 7, 14, 0, 0, 0, 0, time.UTC)) {
+			t.Errorf("expected the recorded time, got %s", rm.Time)
+		}
+	}
+	if len(ids) != 2 || ids[0] != 1 || ids[1] != 2 {
+		t.Errorf("expected meters [1 2], got %v", ids)
+	}
+}
+
+// Writes samples to a temporary file and opens it as the -replay file for
+// -input-format=iq. The returned function closes and removes it.
+func setSampleReplay(t *testing.T, iq []byte) func() {
+	f, err := ioutil.TempFile("", "rtlamr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(iq); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	sampleReplay = openSampleReplay(f.Name(), 0)
+	return func() {
+		sampleReplay.Close()
+		sampleReplay = nil
+		os.Remove(f.Name())
+	}
+}
+
+// Decodes the meter ids and times of json messages written to buf.
+func outputMeterIDs(t *testing.T, buf *bytes.Buffer) (ids []uint32, times []time.Time) {
+	scanner := bufio.NewScanner(buf)
+	for scanner.Scan() {
+		var rm replayMessage
+		if err := json.Unmarshal(scanner.Bytes(), &rm); err != nil {
+			t.Fatal(err)
+		}
+		var msg scm.SCM
+		if err := json.Unmarshal(rm.Message, &msg); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, msg.ID)
+		times = append(times, rm.Time)
+	}
+	return
+}
+
+func TestRunSampleReplay(t *testing.T) {
+	cfg := scm.NewPacketConfig(73)
+	rng := rand.New(rand.NewSource(1))
+
+	var iq []byte
+	for id := uint32(1); id <= 3; id++ {
+		iq = append(iq, testutil.Synthesize(cfg, testutil.NewSCMPacket(id, id*10), cfg.BlockSize2, rng)...)
+	}
+	defer setSampleReplay(t, iq)()
+
+	var rcvr Receiver
+	rcvr.d = decode.NewDecoder(cfg)
+	rcvr.p = scm.NewParser()
+
+	var buf bytes.Buffer
+	output, encoder = &buf, NewEncoder("json", &buf)
+	defer func() {
+		output, encoder = nil, nil
+	}()
+
+	// Run ends at the end of the file.
+	start := time.Now()
+	if received, err := rcvr.Run(context.Background()); err != nil || received != 3 {
+		t.Fatalf("expected 3 messages and no error, got %d and %v", received, err)
+	}
+
+	ids, times := outputMeterIDs(t, &buf)
+	if len(ids) != 3 || ids[0] != 1 || ids[1] != 2 || ids[2] != 3 {
+		t.Errorf("expected meters [1 2 3], got %v", ids)
+	}
+
+	// Samples have no receive time, messages are stamped when decoded.
+	for idx, msgTime := range times {
+		if msgTime.Before(start) {
+			t.Errorf("message %d: expected a time after %s, got %s", idx, start, msgTime)
+		}
+	}
+}
+
+func TestRunReplayLoop(t *testing.T) {
+	cfg := scm.NewPacketConfig(73)
+
+	// A file of two blocks, each a packet long, with one packet in the
+	// middle.
+	if err := cfg.SetBlockSize(cfg.PacketLength << 1); err != nil {
+		t.Fatal(err)
+	}
+	gap := (2*cfg.BlockSize - cfg.PacketLength) / 2
+	iq := testutil.Synthesize(cfg, testutil.NewSCMPacket(1, 10), gap, rand.New(rand.NewSource(1)))
+	if len(iq) != 2*cfg.BlockSize2 {
+		t.Fatalf("expected %d bytes of samples, got %d", 2*cfg.BlockSize2, len(iq))
+	}
+	defer setSampleReplay(t, iq)()
+
+	var rcvr Receiver
+	rcvr.d = decode.NewDecoder(cfg)
+	rcvr.p = scm.NewParser()
+
+	var buf bytes.Buffer
+	output, encoder = &buf, NewEncoder("json", &buf)
+	*replayLoop, *count = true, 3
+	atomic.StoreUint64(&replayLoops, 0)
+	defer func() {
+		output, encoder = nil, nil
+		*replayLoop, *count = false, 0
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// The packet repeats on every pass until -count is reached.
+	if received, err := rcvr.Run(ctx); err != nil || received != 3 {
+		t.Fatalf("expected 3 messages and no error, got %d and %v", received, err)
+	}
+	if ids, _ := outputMeterIDs(t, &buf); len(ids) != 3 || ids[0] != 1 || ids[1] != 1 || ids[2] != 1 {
+		t.Errorf("expected meters [1 1 1], got %v", ids)
+	}
+	if loops := atomic.LoadUint64(&replayLoops); loops < 2 {
+		t.Errorf("expected at least 2 rewinds, got %d", loops)
+	}
+}
+
+func TestRunExitOnMaxParseErrors(t *testing.T) {
+	cfg := scm.NewPacketConfig(73)
+	rng := rand.New(rand.NewSource(1))
+
+	// Meter 1's packet fails its checksum, meter 2's is never reached.
+	bad := testutil.NewSCMPacket(1, 10)
+	bad[len(bad)-1] ^= 0xFF
+	iq := testutil.Synthesize(cfg, bad, cfg.BlockSize2, rng)
+	iq = append(iq, testutil.Synthesize(cfg, testutil.NewSCMPacket(2, 20), cfg.BlockSize2, rng)...)
+	defer setSampleReplay(t, iq)()
+
+	var rcvr Receiver
+	rcvr.d = decode.NewDecoder(cfg)
+	rcvr.p = scm.NewParser()
+
+	var buf bytes.Buffer
+	output, encoder = &buf, NewEncoder("json", &buf)
+	*maxParseErrors, *exitOnMaxParseErrors = 1, true
+	defer func() {
+		output, encoder = nil, nil
+		*maxParseErrors, *exitOnMaxParseErrors = 0, false
+	}()
+
+	var logBuf bytes.Buffer
+	log.SetOutput(&logBuf)
+	defer log.SetOutput(os.Stderr)
+
+	// Run returns the error so main can run -post-run-cmd before exiting.
+	received, err := rcvr.Run(context.Background())
+	if err == nil || received != 0 {
+		t.Fatalf("expected no messages and an error, got %d and %v", received, err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("expected no output, got %q", buf.String())
+	}
+}
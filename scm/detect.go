@@ -0,0 +1,84 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2014 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package scm
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"time"
+)
+
+// Symbol lengths tried by AutoDetectSymbolLength.
+var CandidateSymbolLengths = []int{32, 40}
+
+// CountPackets decodes samples from r until it is exhausted and returns the
+// number of valid SCM packets found with the given symbol length. A partial
+// trailing block is ignored.
+func CountPackets(r io.Reader, symbolLength int) (count int, err error) {
+	d := NewDecoder(symbolLength)
+	block := make([]byte, d.Cfg.BlockSize2)
+
+	for {
+		_, err = io.ReadFull(r, block)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return count, nil
+		}
+		if err != nil {
+			return count, err
+		}
+
+		count += len(d.Decode(block))
+	}
+}
+
+// AutoDetectSymbolLength reads duration worth of samples from r, at the
+// sample rate of the longest candidate symbol length, and decodes them with
+// each candidate. Returns the symbol length which found the most valid
+// packets. Useful for determining the rate a sample file was recorded at.
+func AutoDetectSymbolLength(r io.Reader, duration time.Duration) (int, error) {
+	maxLength := 0
+	for _, symbolLength := range CandidateSymbolLengths {
+		if symbolLength > maxLength {
+			maxLength = symbolLength
+		}
+	}
+
+	size := int64(duration.Seconds()*float64(maxLength*DataRate)) << 1
+
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, r, size); err != nil && err != io.EOF {
+		return 0, err
+	}
+
+	best, bestCount := 0, 0
+	for _, symbolLength := range CandidateSymbolLengths {
+		count, err := CountPackets(bytes.NewReader(buf.Bytes()), symbolLength)
+		if err != nil {
+			return 0, err
+		}
+		if count > bestCount {
+			best, bestCount = symbolLength, count
+		}
+	}
+
+	if bestCount == 0 {
+		return 0, errors.New("no packets found with any candidate symbol length")
+	}
+
+	return best, nil
+}
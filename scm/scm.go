@@ -17,6 +17,8 @@
 package scm
 
 import (
+	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"strconv"
@@ -26,8 +28,25 @@ import (
 	"github.com/bemasher/rtlamr/parse"
 )
 
+func init() {
+	parse.RegisterBinaryMessage(BinaryType, UnmarshalBinary)
+}
+
+// Symbols per second.
+const DataRate = 32768
+
+// NewPacketConfig returns the radio configuration for SCM packets.
+// Symbol length is the number of samples per symbol and determines the sample
+// rate, DataRate times the symbol length. Lengths of 7-9 and 28-97 give
+// sample rates the dongle supports, see decode.CheckSymbolLength, others
+// suit samples decimated from a supported rate. Panics if the symbol length
+// isn't positive.
 func NewPacketConfig(symbolLength int) (cfg decode.PacketConfig) {
-	cfg.DataRate = 32768
+	cfg.DataRate = DataRate
+
+	if symbolLength <= 0 {
+		panic(fmt.Sprintf("scm.NewPacketConfig: invalid symbol length %d", symbolLength))
+	}
 
 	cfg.SymbolLength = symbolLength
 	cfg.SymbolLength2 = cfg.SymbolLength << 1
@@ -50,6 +69,35 @@ func NewPacketConfig(symbolLength int) (cfg decode.PacketConfig) {
 	return
 }
 
+// Decoder combines a decoder and parser, decoding SCM messages directly
+// from sample blocks.
+type Decoder struct {
+	decode.Decoder
+	Parser
+}
+
+// Create a new decoder for SCM messages with the given symbol length.
+func NewDecoder(symbolLength int, opts ...decode.Option) (d Decoder) {
+	d.Decoder = decode.NewDecoder(NewPacketConfig(symbolLength), opts...)
+	d.Parser = NewParser()
+	return
+}
+
+// Decode returns the valid SCM messages found in the given sample block.
+// Packets which fail to parse are counted as checksum failures in the
+// decoder's stats.
+func (d Decoder) Decode(block []byte) (msgs []SCM) {
+	for _, pkt := range d.Decoder.Decode(block) {
+		msg, err := d.Parse(parse.NewDataFromBytes(pkt))
+		if err != nil {
+			d.AddCRCFailure()
+			continue
+		}
+		msgs = append(msgs, msg.(SCM))
+	}
+	return
+}
+
 type Parser struct {
 	crc.CRC
 }
@@ -59,24 +107,54 @@ func NewParser() (p Parser) {
 	return
 }
 
-func (p Parser) Parse(data parse.Data) (msg parse.Message, err error) {
-	var scm SCM
+// Type returns "scm".
+func (p Parser) Type() string {
+	return "scm"
+}
 
+func (p Parser) Parse(data parse.Data) (msg parse.Message, err error) {
 	if l := len(data.Bytes); l < 12 {
 		err = fmt.Errorf("packet too short: %d", l)
 		return
 	}
-	if p.Checksum(data.Bytes[2:12]) != 0 {
-		err = errors.New("checksum failed")
+	if !parse.CheckCRC(data, p.CRC, 2, 12) {
+		err = parse.NewCRCError(data, p.CRC, 2, 12)
 		return
 	}
 
-	ertid, _ := strconv.ParseUint(data.Bits[21:23]+data.Bits[56:80], 2, 32)
-	erttype, _ := strconv.ParseUint(data.Bits[26:30], 2, 8)
-	tamperphy, _ := strconv.ParseUint(data.Bits[24:26], 2, 8)
-	tamperenc, _ := strconv.ParseUint(data.Bits[30:32], 2, 8)
-	consumption, _ := strconv.ParseUint(data.Bits[32:56], 2, 32)
-	checksum, _ := strconv.ParseUint(data.Bits[80:96], 2, 16)
+	return p.ParseUnchecked(data)
+}
+
+// ParseBatch parses each of the given packets. The returned slices are the
+// same length as packets, each error is nil if the packet at that position
+// parsed successfully.
+func (p Parser) ParseBatch(packets []parse.Data) (msgs []parse.Message, errs []error) {
+	msgs = make([]parse.Message, len(packets))
+	errs = make([]error, len(packets))
+	for idx, data := range packets {
+		msgs[idx], errs[idx] = p.Parse(data)
+	}
+	return
+}
+
+// ParseUnchecked parses a packet without verifying its checksum, fields of a
+// corrupt packet may be garbage.
+func (p Parser) ParseUnchecked(data parse.Data) (msg parse.Message, err error) {
+	var scm SCM
+
+	if l := len(data.Bytes); l < 12 {
+		err = fmt.Errorf("packet too short: %d", l)
+		return
+	}
+
+	// The two most significant bits of the id precede the other fields.
+	ertid := data.Extract(21, 2)<<24 | data.Extract(56, 24)
+	erttype := data.Extract(26, 4)
+	tamperphy := data.Extract(24, 2)
+	tamperenc := data.Extract(30, 2)
+	reserved := data.Extract(23, 1)
+	consumption := data.Extract(32, 24)
+	checksum := data.Extract(80, 16)
 
 	scm.ID = uint32(ertid)
 	scm.Type = uint8(erttype)
@@ -84,6 +162,7 @@ func (p Parser) Parse(data parse.Data) (msg parse.Message, err error) {
 	scm.TamperEnc = uint8(tamperenc)
 	scm.Consumption = uint32(consumption)
 	scm.Checksum = uint16(checksum)
+	scm.reserved = uint8(reserved)
 
 	if scm.ID == 0 {
 		err = errors.New("invalid ert id")
@@ -100,6 +179,8 @@ type SCM struct {
 	TamperEnc   uint8  `xml:",attr"`
 	Consumption uint32 `xml:",attr"`
 	Checksum    uint16 `xml:",attr"`
+
+	reserved uint8
 }
 
 func (scm SCM) MsgType() string {
@@ -114,6 +195,15 @@ func (scm SCM) MeterType() uint8 {
 	return scm.Type
 }
 
+// ExtraFields returns the consumption and tamper flags.
+func (scm SCM) ExtraFields() map[string]interface{} {
+	return map[string]interface{}{
+		"consumption": scm.Consumption,
+		"tamper_phy":  scm.TamperPhy,
+		"tamper_enc":  scm.TamperEnc,
+	}
+}
+
 func (scm SCM) String() string {
 	return fmt.Sprintf("{ID:%8d Type:%2d Tamper:{Phy:%02X Enc:%02X} Consumption:%8d CRC:0x%04X}",
 		scm.ID, scm.Type, scm.TamperPhy, scm.TamperEnc, scm.Consumption, scm.Checksum,
@@ -130,3 +220,66 @@ func (scm SCM) Record() (r []string) {
 
 	return
 }
+
+// Validate returns a list of warnings about field values which are valid
+// but unusual. A packet which passes its checksum may still carry values
+// which don't make sense.
+func (scm SCM) Validate() (warnings []string) {
+	if scm.Consumption == 0 {
+		warnings = append(warnings, "consumption is zero, meter may be new or reset")
+	}
+	if _, ok := parse.MeterTypeName[scm.Type]; !ok {
+		warnings = append(warnings, fmt.Sprintf("unknown meter type: %d", scm.Type))
+	}
+	if scm.TamperPhy != 0 {
+		warnings = append(warnings, fmt.Sprintf("physical tamper set: 0x%02X", scm.TamperPhy))
+	}
+	if scm.reserved != 0 {
+		warnings = append(warnings, "reserved field is non-zero")
+	}
+
+	return
+}
+
+// Identifies SCM messages in binary encoded log messages.
+const BinaryType = 0x01
+
+type scmBinary struct {
+	ID          uint32
+	Type        uint8
+	TamperPhy   uint8
+	TamperEnc   uint8
+	Reserved    uint8
+	Consumption uint32
+	Checksum    uint16
+}
+
+func (scm SCM) BinaryType() uint8 {
+	return BinaryType
+}
+
+func (scm SCM) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	err := binary.Write(&buf, binary.BigEndian, scmBinary{
+		scm.ID, scm.Type, scm.TamperPhy, scm.TamperEnc, scm.reserved, scm.Consumption, scm.Checksum,
+	})
+	return buf.Bytes(), err
+}
+
+// Decodes an SCM message encoded by MarshalBinary.
+func UnmarshalBinary(data []byte) (msg parse.Message, err error) {
+	var b scmBinary
+	if err = binary.Read(bytes.NewReader(data), binary.BigEndian, &b); err != nil {
+		return
+	}
+
+	return SCM{
+		ID:          b.ID,
+		Type:        b.Type,
+		TamperPhy:   b.TamperPhy,
+		TamperEnc:   b.TamperEnc,
+		Consumption: b.Consumption,
+		Checksum:    b.Checksum,
+		reserved:    b.Reserved,
+	}, nil
+}
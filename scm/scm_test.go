@@ -0,0 +1,341 @@
+package scm
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bemasher/rtlamr/internal/testutil"
+	"github.com/bemasher/rtlamr/parse"
+)
+
+func TestSCMParseIntegration(t *testing.T) {
+	expected := []SCM{
+		{ID: 10000001, Type: 7, TamperPhy: 0, TamperEnc: 0, Consumption: 1234567, Checksum: 0x40BB},
+		{ID: 20000002, Type: 12, TamperPhy: 1, TamperEnc: 2, Consumption: 54321, Checksum: 0x3297},
+		{ID: 30000003, Type: 11, TamperPhy: 0, TamperEnc: 0, Consumption: 987, Checksum: 0x3F77},
+	}
+
+	pkts := testutil.ReadPackets(t, "testdata/packets.txt")
+	if len(pkts) != len(expected) {
+		t.Fatalf("expected %d packets, got %d", len(expected), len(pkts))
+	}
+
+	p := NewParser()
+	for idx, pkt := range pkts {
+		msg, err := p.Parse(pkt)
+		if err != nil {
+			t.Errorf("packet %d: %s", idx, err)
+			continue
+		}
+
+		if scm := msg.(SCM); scm != expected[idx] {
+			t.Errorf("packet %d: expected %+v, got %+v", idx, expected[idx], scm)
+		}
+	}
+}
+
+func TestSCMParseBatch(t *testing.T) {
+	pkts := testutil.ReadPackets(t, "testdata/packets.txt")
+
+	corrupt := parse.NewDataFromBytes(append([]byte(nil), pkts[1].Bytes...))
+	corrupt.Bytes[5] ^= 0xFF
+
+	batch := []parse.Data{pkts[0], corrupt, parse.NewDataFromBytes(pkts[2].Bytes[:8]), pkts[2]}
+
+	p := NewParser()
+	msgs, errs := p.ParseBatch(batch)
+	if len(msgs) != len(batch) || len(errs) != len(batch) {
+		t.Fatalf("expected %d results, got %d messages and %d errors", len(batch), len(msgs), len(errs))
+	}
+
+	for idx, valid := range []bool{true, false, false, true} {
+		if (errs[idx] == nil) != valid {
+			t.Errorf("packet %d: expected valid %v, got error %v", idx, valid, errs[idx])
+			continue
+		}
+		if !valid {
+			continue
+		}
+
+		expected, _ := p.Parse(batch[idx])
+		if msgs[idx] != expected {
+			t.Errorf("packet %d: expected %+v, got %+v", idx, expected, msgs[idx])
+		}
+	}
+
+	if msgs, errs := p.ParseBatch(nil); len(msgs) != 0 || len(errs) != 0 {
+		t.Errorf("expected no results for no packets, got %v and %v", msgs, errs)
+	}
+}
+
+func TestNewPacketConfigInvalid(t *testing.T) {
+	for _, symbolLength := range []int{-1, 0} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("symbol length %d: expected panic", symbolLength)
+				}
+			}()
+			NewPacketConfig(symbolLength)
+		}()
+	}
+
+	// Lengths at rates the dongle doesn't support suit decimated samples.
+	for _, symbolLength := range []int{1, 7, 9, 18, 28, 73, 97, 98} {
+		NewPacketConfig(symbolLength)
+	}
+}
+
+func TestAutoDetectSymbolLength(t *testing.T) {
+	pkts := testutil.ReadPackets(t, "testdata/packets.txt")
+	rng := rand.New(rand.NewSource(1))
+
+	for _, symbolLength := range CandidateSymbolLengths {
+		cfg := NewPacketConfig(symbolLength)
+
+		var iq []byte
+		for _, pkt := range pkts {
+			iq = append(iq, testutil.Synthesize(cfg, pkt.Bytes, cfg.BlockSize2, rng)...)
+		}
+
+		detected, err := AutoDetectSymbolLength(bytes.NewReader(iq), time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if detected != symbolLength {
+			t.Errorf("expected symbol length %d, got %d", symbolLength, detected)
+		}
+	}
+
+	if _, err := AutoDetectSymbolLength(bytes.NewReader(make([]byte, 1<<20)), time.Second); err == nil {
+		t.Error("expected error for samples without packets")
+	}
+}
+
+func TestDecoder(t *testing.T) {
+	pkts := testutil.ReadPackets(t, "testdata/packets.txt")
+	d := NewDecoder(72)
+	rng := rand.New(rand.NewSource(1))
+
+	// Every packet, then the first with a corrupted checksum.
+	var iq []byte
+	for _, pkt := range pkts {
+		iq = append(iq, testutil.Synthesize(d.Cfg, pkt.Bytes, d.Cfg.BlockSize2, rng)...)
+	}
+	corrupt := append([]byte(nil), pkts[0].Bytes...)
+	corrupt[len(corrupt)-1] ^= 0xFF
+	iq = append(iq, testutil.Synthesize(d.Cfg, corrupt, d.Cfg.BlockSize2, rng)...)
+
+	// Neighbouring offsets may decode the same packet more than once.
+	found := map[uint32]bool{}
+	blockSize := d.Cfg.BlockSize2
+	for idx := 0; idx+blockSize <= len(iq); idx += blockSize {
+		for _, msg := range d.Decode(iq[idx : idx+blockSize]) {
+			found[msg.MeterID()] = true
+		}
+	}
+
+	p := NewParser()
+	for idx, pkt := range pkts {
+		msg, err := p.Parse(pkt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !found[msg.MeterID()] {
+			t.Errorf("packet %d: meter %d not decoded", idx, msg.MeterID())
+		}
+	}
+	if len(found) != len(pkts) {
+		t.Errorf("expected %d meters, got %d", len(pkts), len(found))
+	}
+
+	if d.Stats().CRCFailures == 0 {
+		t.Error("expected the corrupted packet to be counted as a checksum failure")
+	}
+}
+
+func TestSCMBinaryRoundTrip(t *testing.T) {
+	msg, err := NewParser().Parse(testutil.ReadPackets(t, "testdata/packets.txt")[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	valid, invalid := true, false
+	for _, expected := range []parse.LogMessage{
+		{
+			Time:      time.Unix(1500000000, 123456789),
+			Offset:    4096,
+			Length:    16384,
+			Message:   msg,
+			RawPacket: "F9A5",
+			Warnings:  []string{"first warning", "second warning"},
+			CRCValid:  &valid,
+			Tags:      parse.Tags{"site": "building-A", "antenna": "roof"},
+		},
+		{Time: time.Unix(1500000000, 0), Message: msg, CRCValid: &invalid},
+		{Time: time.Unix(1500000000, 0), Message: msg},
+	} {
+		encoded, err := expected.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var decoded parse.LogMessage
+		if err := decoded.UnmarshalBinary(encoded); err != nil {
+			t.Fatal(err)
+		}
+
+		if !decoded.Time.Equal(expected.Time) {
+			t.Errorf("expected time %s, got %s", expected.Time, decoded.Time)
+		}
+		decoded.Time = expected.Time
+		if !reflect.DeepEqual(decoded, expected) {
+			t.Errorf("expected %+v, got %+v", expected, decoded)
+		}
+	}
+}
+
+func TestSCMJSONRoundTrip(t *testing.T) {
+	// The unexported reserved bit isn't encoded so it's left zero.
+	expected := SCM{ID: 12345678, Type: 7, TamperPhy: 1, TamperEnc: 2, Consumption: 1234567, Checksum: 0xBEEF}
+
+	data, err := json.Marshal(expected)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var msg SCM
+	if err := json.Unmarshal(data, &msg); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(msg, expected) {
+		t.Errorf("expected %+v, got %+v from %s", expected, msg, data)
+	}
+}
+
+func TestParseUnchecked(t *testing.T) {
+	p := NewParser()
+
+	data := testutil.ReadPackets(t, "testdata/packets.txt")[0].Bytes
+	expected, err := p.Parse(parse.NewDataFromBytes(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Corrupt the least significant bit of consumption.
+	corrupt := append([]byte(nil), data...)
+	corrupt[6] ^= 0x01
+
+	if _, err := p.Parse(parse.NewDataFromBytes(corrupt)); err == nil {
+		t.Fatal("expected checksum error")
+	} else if _, ok := err.(parse.CRCError); !ok {
+		t.Fatalf("expected parse.CRCError, got %T: %s", err, err)
+	}
+
+	msg, err := p.ParseUnchecked(parse.NewDataFromBytes(corrupt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.(SCM).Consumption != expected.(SCM).Consumption^1 {
+		t.Errorf("expected consumption %d, got %d", expected.(SCM).Consumption^1, msg.(SCM).Consumption)
+	}
+
+	// Checksum validity survives binary encoding.
+	valid := false
+	logMsg := parse.LogMessage{Time: time.Unix(0, 0), Message: msg, CRCValid: &valid}
+
+	encoded, err := logMsg.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded parse.LogMessage
+	if err := decoded.UnmarshalBinary(encoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.CRCValid == nil || *decoded.CRCValid {
+		t.Errorf("expected CRCValid false, got %v", decoded.CRCValid)
+	}
+}
+
+func TestToInfluxPoint(t *testing.T) {
+	expected := []string{
+		"rtlamr,meter_id=10000001,meter_type=7,msg_type=SCM consumption=1234567i,meter_id=10000001i,tamper_enc=0i,tamper_phy=0i 1500000000000000000",
+		"rtlamr,meter_id=20000002,meter_type=12,msg_type=SCM consumption=54321i,meter_id=20000002i,tamper_enc=2i,tamper_phy=1i 1500000000000000000",
+		"rtlamr,meter_id=30000003,meter_type=11,msg_type=SCM consumption=987i,meter_id=30000003i,tamper_enc=0i,tamper_phy=0i 1500000000000000000",
+	}
+
+	p := NewParser()
+	for idx, pkt := range testutil.ReadPackets(t, "testdata/packets.txt") {
+		msg, err := p.Parse(pkt)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		logMsg := parse.LogMessage{Time: time.Unix(1500000000, 0), Message: msg}
+		if point := logMsg.ToInfluxPoint(); point != expected[idx] {
+			t.Errorf("packet %d: expected %q, got %q", idx, expected[idx], point)
+		}
+	}
+}
+
+func TestTags(t *testing.T) {
+	msg, err := NewParser().Parse(testutil.ReadPackets(t, "testdata/packets.txt")[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tags := parse.Tags{"site": "building-A", "antenna": "roof"}
+
+	// Tags survive binary encoding with and without checksum validity.
+	valid := true
+	for _, crcValid := range []*bool{nil, &valid} {
+		logMsg := parse.LogMessage{Time: time.Unix(0, 0), Message: msg, CRCValid: crcValid, Tags: tags}
+
+		encoded, err := logMsg.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var decoded parse.LogMessage
+		if err := decoded.UnmarshalBinary(encoded); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(decoded.Tags, tags) {
+			t.Errorf("expected tags %v, got %v", tags, decoded.Tags)
+		}
+		if !reflect.DeepEqual(decoded.CRCValid, crcValid) {
+			t.Errorf("expected CRCValid %v, got %v", crcValid, decoded.CRCValid)
+		}
+	}
+
+	logMsg := parse.LogMessage{Time: time.Unix(0, 0), Message: msg, Tags: tags}
+
+	data, err := json.Marshal(logMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"tags":{"antenna":"roof","site":"building-A"}`) {
+		t.Errorf("expected tags in json, got %s", data)
+	}
+
+	data, err = xml.Marshal(logMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `<Tags><Tag Key="antenna">roof</Tag><Tag Key="site">building-A</Tag></Tags>`) {
+		t.Errorf("expected tags in xml, got %s", data)
+	}
+
+	record := logMsg.Record()
+	if n := len(record); record[n-2] != "roof" || record[n-1] != "building-A" {
+		t.Errorf("expected tags in last columns, got %q", record)
+	}
+}
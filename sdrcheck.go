@@ -0,0 +1,68 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2014 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math"
+)
+
+const (
+	// Power thresholds in dBFS beyond which -check-sdr warns. Samples are
+	// 8-bit so power can't fall below about -45 dBFS, where every sample is
+	// within half a count of the midpoint. The low threshold is an RMS of
+	// about 1.3 counts per component.
+	LowPowerThreshold  = -40
+	HighPowerThreshold = -10
+
+	// Samples read by -check-sdr to measure power.
+	CheckSDRSamples = 1 << 18
+)
+
+// RMSPower returns the RMS power of 8-bit interleaved IQ samples in dB
+// relative to full scale.
+func RMSPower(iq []byte) float64 {
+	var sum float64
+	for _, v := range iq {
+		s := (float64(v) - 127.5) / 127.5
+		sum += s * s
+	}
+
+	// Each sample's power is the sum of its I and Q components'.
+	return 10 * math.Log10(2*sum/float64(len(iq)))
+}
+
+// checkSDR reads a block of samples from the connected dongle and reports
+// the gain count and signal power.
+func (rcvr *Receiver) checkSDR() {
+	iq := make([]byte, CheckSDRSamples<<1)
+	if _, err := io.ReadFull(rcvr, iq); err != nil {
+		log.Fatal("Error reading samples: ", err)
+	}
+
+	power := RMSPower(iq)
+	fmt.Printf("RTL-SDR connected: gain_count=%d rms_power=%0.1f\n", rcvr.SDR.Info.GainCount, power)
+
+	switch {
+	case power < LowPowerThreshold:
+		log.Printf("Signal power %0.1f dBFS is very low, the antenna may not be connected\n", power)
+	case power > HighPowerThreshold:
+		log.Printf("Signal power %0.1f dBFS is very high, samples may be clipping, try reducing gain\n", power)
+	}
+}
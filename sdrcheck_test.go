@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/bemasher/rtlamr/internal/testutil"
+)
+
+func TestRMSPower(t *testing.T) {
+	testCases := []struct {
+		name     string
+		iq       []byte
+		expected float64
+	}{
+		// Every component half a count from the midpoint, the lowest power
+		// 8-bit samples can have.
+		{"floor", bytes.Repeat([]byte{127, 128}, 512), 10 * math.Log10(2/(255.0*255.0))},
+		{"full scale", bytes.Repeat([]byte{0, 255}, 512), 10 * math.Log10(2)},
+		{"noise", noise(1<<16, testutil.NoiseLevel, rand.New(rand.NewSource(1))), 10 * math.Log10(2*testutil.NoiseLevel*testutil.NoiseLevel/(127.5*127.5))},
+	}
+
+	for _, tc := range testCases {
+		if power := RMSPower(tc.iq); math.Abs(power-tc.expected) > 0.1 {
+			t.Errorf("%s: expected %0.2f dBFS, got %0.2f dBFS", tc.name, tc.expected, power)
+		}
+	}
+
+	// The floor must be below the low power warning so it can be reached.
+	if floor := RMSPower(bytes.Repeat([]byte{127, 128}, 512)); floor >= LowPowerThreshold {
+		t.Errorf("expected the %0.1f dBFS floor to be below the %d dBFS threshold", floor, LowPowerThreshold)
+	}
+}
@@ -0,0 +1,172 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2014 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package session records and replays rtl_tcp sessions. A session is the
+// dongle info header sent by rtl_tcp, the commands sent by the client and
+// the stream of samples received, each timestamped so a replay reproduces
+// the original sequence and timing.
+package session
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+// Record types.
+const (
+	Info uint8 = iota
+	Command
+	Samples
+)
+
+// rtl_tcp command codes.
+const (
+	SetCenterFreq     uint8 = 0x01
+	SetSampleRate     uint8 = 0x02
+	SetGainMode       uint8 = 0x03
+	SetGain           uint8 = 0x04
+	SetFreqCorrection uint8 = 0x05
+	SetTestMode       uint8 = 0x07
+	SetAGCMode        uint8 = 0x08
+	SetDirectSampling uint8 = 0x09
+	SetOffsetTuning   uint8 = 0x0A
+	SetRTLXtalFreq    uint8 = 0x0B
+	SetTunerXtalFreq  uint8 = 0x0C
+	SetGainByIndex    uint8 = 0x0D
+)
+
+// A Record is a single timestamped event in a session. Records are stored
+// as type, time in nanoseconds since the unix epoch, data length and data,
+// all big-endian.
+type Record struct {
+	Type uint8
+	Time time.Time
+	Data []byte
+}
+
+type header struct {
+	Type   uint8
+	Time   int64
+	Length uint32
+}
+
+// A Writer writes session records to an underlying writer.
+type Writer struct {
+	w io.Writer
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w}
+}
+
+func (sw *Writer) write(recordType uint8, data []byte) error {
+	hdr := header{recordType, time.Now().UnixNano(), uint32(len(data))}
+	if err := binary.Write(sw.w, binary.BigEndian, hdr); err != nil {
+		return err
+	}
+
+	_, err := sw.w.Write(data)
+	return err
+}
+
+// WriteInfo records the dongle info header as sent by rtl_tcp.
+func (sw *Writer) WriteInfo(info []byte) error {
+	return sw.write(Info, info)
+}
+
+// WriteCommand records a command sent to rtl_tcp.
+func (sw *Writer) WriteCommand(cmd uint8, param uint32) error {
+	data := make([]byte, 5)
+	data[0] = cmd
+	binary.BigEndian.PutUint32(data[1:], param)
+	return sw.write(Command, data)
+}
+
+// WriteSamples records a block of samples received from rtl_tcp.
+func (sw *Writer) WriteSamples(samples []byte) error {
+	return sw.write(Samples, samples)
+}
+
+// A Reader reads session records from an underlying reader.
+type Reader struct {
+	r io.Reader
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r}
+}
+
+// Next returns the next record in the session or io.EOF.
+func (sr *Reader) Next() (rec Record, err error) {
+	var hdr header
+	if err = binary.Read(sr.r, binary.BigEndian, &hdr); err != nil {
+		return
+	}
+
+	rec.Type = hdr.Type
+	rec.Time = time.Unix(0, hdr.Time)
+	rec.Data = make([]byte, hdr.Length)
+
+	_, err = io.ReadFull(sr.r, rec.Data)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return
+}
+
+// Serve replays the session read from r to conn as if it were an rtl_tcp
+// server. The dongle info header is sent first, followed by samples paced
+// according to their recorded times. Commands sent by the client are
+// discarded.
+func Serve(conn net.Conn, r io.Reader) error {
+	go io.Copy(ioutil.Discard, conn)
+
+	sr := NewReader(r)
+
+	var first time.Time
+	start := time.Now()
+	for {
+		rec, err := sr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if first.IsZero() {
+			first = rec.Time
+		}
+		time.Sleep(rec.Time.Sub(first) - time.Since(start))
+
+		switch rec.Type {
+		case Info, Samples:
+			_, err = conn.Write(rec.Data)
+		case Command:
+		default:
+			err = fmt.Errorf("invalid record type: %d", rec.Type)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package session
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var (
+	testInfo    = []byte{'R', 'T', 'L', '0', 0, 0, 0, 5, 0, 0, 0, 29}
+	testSamples = [][]byte{{127, 128, 126, 129}, {1, 2, 3, 4, 5, 6}}
+)
+
+// Records a session of dongle info, a command and two blocks of samples.
+func recordSession(t *testing.T) []byte {
+	var buf bytes.Buffer
+	sw := NewWriter(&buf)
+
+	if err := sw.WriteInfo(testInfo); err != nil {
+		t.Fatal(err)
+	}
+	if err := sw.WriteCommand(SetCenterFreq, 912600155); err != nil {
+		t.Fatal(err)
+	}
+	for _, samples := range testSamples {
+		if err := sw.WriteSamples(samples); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return buf.Bytes()
+}
+
+func TestWriterReader(t *testing.T) {
+	start := time.Now()
+	sr := NewReader(bytes.NewReader(recordSession(t)))
+
+	expected := []Record{
+		{Type: Info, Data: testInfo},
+		{Type: Command, Data: []byte{SetCenterFreq, 0x36, 0x65, 0x2C, 0x5B}},
+		{Type: Samples, Data: testSamples[0]},
+		{Type: Samples, Data: testSamples[1]},
+	}
+
+	var last time.Time
+	for idx, exp := range expected {
+		rec, err := sr.Next()
+		if err != nil {
+			t.Fatalf("record %d: %s", idx, err)
+		}
+
+		if rec.Time.Before(start) || rec.Time.Before(last) {
+			t.Errorf("record %d: expected time after %s, got %s", idx, last, rec.Time)
+		}
+		last = rec.Time
+
+		rec.Time = time.Time{}
+		if !reflect.DeepEqual(rec, exp) {
+			t.Errorf("record %d: expected %+v, got %+v", idx, exp, rec)
+		}
+	}
+
+	if _, err := sr.Next(); err != io.EOF {
+		t.Errorf("expected io.EOF, got %v", err)
+	}
+}
+
+func TestReaderTruncated(t *testing.T) {
+	data := recordSession(t)
+
+	sr := NewReader(bytes.NewReader(data[:len(data)-1]))
+	for {
+		_, err := sr.Next()
+		if err == nil {
+			continue
+		}
+		if err != io.ErrUnexpectedEOF {
+			t.Errorf("expected io.ErrUnexpectedEOF, got %v", err)
+		}
+		break
+	}
+}
+
+func TestServe(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	served := make(chan error, 1)
+	go func() {
+		served <- Serve(server, bytes.NewReader(recordSession(t)))
+		server.Close()
+	}()
+
+	// Commands sent by the client are discarded.
+	if _, err := client.Write([]byte{SetSampleRate, 0, 0x24, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	received, err := ioutil.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := append(append(append([]byte(nil), testInfo...), testSamples[0]...), testSamples[1]...)
+	if !bytes.Equal(received, expected) {
+		t.Errorf("expected %v, got %v", expected, received)
+	}
+
+	if err := <-served; err != nil {
+		t.Errorf("expected Serve to finish cleanly, got %s", err)
+	}
+}
+
+func TestServeInvalidRecord(t *testing.T) {
+	var buf bytes.Buffer
+	if err := NewWriter(&buf).write(Samples+1, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	server, client := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	if err := Serve(server, &buf); err == nil {
+		t.Error("expected error for an invalid record type")
+	}
+}
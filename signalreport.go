@@ -0,0 +1,231 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2014 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"math"
+	"math/cmplx"
+	"time"
+)
+
+const (
+	// Samples per FFT used to measure the spectrum of received blocks.
+	SignalReportFFTSize = 1024
+
+	// Width of the sub-bands power is reported for.
+	SignalReportBandWidth = 1000000
+
+	// Added to measured power so silent bands are reported as -200 dBFS
+	// rather than -Inf, which json can't encode.
+	powerFloor = 1e-20
+)
+
+// BandPower is the mean power of received samples in a frequency range.
+type BandPower struct {
+	Lower, Upper int64   // Frequency range in Hz, upper bound exclusive.
+	Power        float64 // Mean power in dBFS.
+}
+
+// SignalReport summarizes received samples over a report interval.
+type SignalReport struct {
+	Time         time.Time
+	Blocks       uint64
+	CenterFreq   int64
+	SampleRate   int
+	Bands        []BandPower
+	PeakOffset   float64 // Offset in Hz from the center frequency of the strongest FFT bin, excluding DC.
+	ClippingRate float64 // Fraction of I and Q components at either extreme.
+}
+
+// SignalMeter accumulates the spectrum and clipping of received samples.
+type SignalMeter struct {
+	centerFreq int64
+	sampleRate int
+
+	spectrum []float64
+	ffts     int
+	buf      []complex128
+
+	blocks           uint64
+	clipped, samples uint64
+}
+
+func NewSignalMeter(centerFreq int64, sampleRate int) *SignalMeter {
+	return &SignalMeter{
+		centerFreq: centerFreq,
+		sampleRate: sampleRate,
+		spectrum:   make([]float64, SignalReportFFTSize),
+		buf:        make([]complex128, SignalReportFFTSize),
+	}
+}
+
+// Adds a block of 8-bit interleaved IQ samples. A trailing partial FFT's
+// worth of samples contributes to clipping but not to the spectrum.
+func (sm *SignalMeter) Add(iq []byte) {
+	sm.blocks++
+
+	for _, v := range iq {
+		if v == 0 || v == 0xFF {
+			sm.clipped++
+		}
+	}
+	sm.samples += uint64(len(iq))
+
+	const n = SignalReportFFTSize
+	for ; len(iq) >= n<<1; iq = iq[n<<1:] {
+		for idx := range sm.buf {
+			i := (float64(iq[idx<<1]) - 127.5) / 127.5
+			q := (float64(iq[idx<<1+1]) - 127.5) / 127.5
+			sm.buf[idx] = complex(i, q)
+		}
+
+		fft(sm.buf)
+
+		// By Parseval's theorem bin powers scaled by 1/n² sum to the mean
+		// power of the samples.
+		for idx, v := range sm.buf {
+			a := cmplx.Abs(v)
+			sm.spectrum[idx] += a * a / (n * n)
+		}
+		sm.ffts++
+	}
+}
+
+// Returns the offset in Hz from the center frequency of FFT bin idx.
+func (sm *SignalMeter) binOffset(idx int) float64 {
+	if idx >= SignalReportFFTSize/2 {
+		idx -= SignalReportFFTSize
+	}
+	return float64(idx) * float64(sm.sampleRate) / SignalReportFFTSize
+}
+
+// Report summarizes samples added since the last report, then resets.
+// Only sub-bands of the ISM band within the received bandwidth are reported.
+func (sm *SignalMeter) Report() (r SignalReport) {
+	r.Time = time.Now()
+	r.Blocks = sm.blocks
+	r.CenterFreq = sm.centerFreq
+	r.SampleRate = sm.sampleRate
+
+	if sm.samples > 0 {
+		r.ClippingRate = float64(sm.clipped) / float64(sm.samples)
+	}
+
+	if sm.ffts > 0 {
+		for lower := int64(ISMLower); lower < ISMUpper; lower += SignalReportBandWidth {
+			upper := lower + SignalReportBandWidth
+
+			var power float64
+			bins := 0
+			for idx, p := range sm.spectrum {
+				freq := sm.centerFreq + int64(sm.binOffset(idx))
+				if freq >= lower && freq < upper {
+					power += p
+					bins++
+				}
+			}
+			if bins == 0 {
+				continue
+			}
+
+			power /= float64(sm.ffts)
+			r.Bands = append(r.Bands, BandPower{lower, upper, 10 * math.Log10(power+powerFloor)})
+		}
+
+		peak := 1
+		for idx := range sm.spectrum[1:] {
+			if sm.spectrum[idx+1] > sm.spectrum[peak] {
+				peak = idx + 1
+			}
+		}
+		r.PeakOffset = sm.binOffset(peak)
+	}
+
+	for idx := range sm.spectrum {
+		sm.spectrum[idx] = 0
+	}
+	sm.ffts = 0
+	sm.blocks = 0
+	sm.clipped, sm.samples = 0, 0
+
+	return
+}
+
+// In place radix-2 decimation in time FFT, len(x) must be a power of 2.
+func fft(x []complex128) {
+	n := len(x)
+
+	// Bit reversal permutation.
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j ^= bit
+		if i < j {
+			x[i], x[j] = x[j], x[i]
+		}
+	}
+
+	for size := 2; size <= n; size <<= 1 {
+		step := cmplx.Exp(complex(0, -2*math.Pi/float64(size)))
+		for start := 0; start < n; start += size {
+			w := complex(1, 0)
+			for k := 0; k < size/2; k++ {
+				even, odd := x[start+k], w*x[start+k+size/2]
+				x[start+k] = even + odd
+				x[start+k+size/2] = even - odd
+				w *= step
+			}
+		}
+	}
+}
+
+// reportSignal receives samples until ctx is cancelled or the time limit is
+// reached, writing a SignalReport as a line of json to the output every
+// interval instead of decoding messages.
+func (rcvr *Receiver) reportSignal(ctx context.Context, interval time.Duration) {
+	sampleRate := rcvr.d.Cfg.SampleRate * *downsample
+	sm := NewSignalMeter(int64(rcvr.Flags.CenterFreq)+int64(*centerFreqOffset), sampleRate)
+
+	var deadline time.Time
+	if *timeLimit != 0 {
+		deadline = time.Now().Add(*timeLimit)
+	}
+
+	enc := json.NewEncoder(output)
+	block := make([]byte, rcvr.d.Cfg.BlockSize2**downsample)
+	last := time.Now()
+	for ctx.Err() == nil && (deadline.IsZero() || time.Now().Before(deadline)) {
+		if _, err := io.ReadFull(rcvr, block); err != nil {
+			log.Fatal("Error reading samples: ", err)
+		}
+		sm.Add(block)
+
+		if time.Since(last) >= interval {
+			last = time.Now()
+			if err := enc.Encode(sm.Report()); err != nil {
+				log.Fatal("Error writing signal report: ", err)
+			}
+			flushOutput()
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"math"
+	"math/cmplx"
+	"math/rand"
+	"testing"
+)
+
+func TestFFT(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+
+	x := make([]complex128, 64)
+	for idx := range x {
+		x[idx] = complex(rng.NormFloat64(), rng.NormFloat64())
+	}
+
+	// Naive DFT for comparison.
+	expected := make([]complex128, len(x))
+	for k := range expected {
+		for n, v := range x {
+			expected[k] += v * cmplx.Exp(complex(0, -2*math.Pi*float64(k*n)/float64(len(x))))
+		}
+	}
+
+	fft(x)
+	for idx := range x {
+		if cmplx.Abs(x[idx]-expected[idx]) > 1e-9 {
+			t.Fatalf("bin %d: expected %v, got %v", idx, expected[idx], x[idx])
+		}
+	}
+}
+
+func TestSignalMeter(t *testing.T) {
+	const (
+		centerFreq = 915000000
+		sampleRate = 2359296
+		offset     = 300000
+	)
+
+	iq := make([]byte, 1<<16)
+	for idx := 0; idx < len(iq)>>1; idx++ {
+		phase := 2 * math.Pi * offset * float64(idx) / sampleRate
+		iq[idx<<1] = byte(127.5 + 64*math.Cos(phase))
+		iq[idx<<1+1] = byte(127.5 + 64*math.Sin(phase))
+	}
+	iq[0], iq[1] = 0, 0xFF
+
+	sm := NewSignalMeter(centerFreq, sampleRate)
+	sm.Add(iq)
+	r := sm.Report()
+
+	binWidth := float64(sampleRate) / SignalReportFFTSize
+	if math.Abs(r.PeakOffset-offset) > binWidth {
+		t.Errorf("expected peak offset %d±%0.0f Hz, got %0.0f", offset, binWidth, r.PeakOffset)
+	}
+
+	if r.Blocks != 1 || r.ClippingRate != 2/float64(len(iq)) {
+		t.Errorf("expected 1 block and clipping rate %g, got %d and %g", 2/float64(len(iq)), r.Blocks, r.ClippingRate)
+	}
+
+	// The received band spans 913.8-916.2 MHz.
+	if len(r.Bands) != 4 || r.Bands[0].Lower != 913000000 {
+		t.Fatalf("unexpected bands: %+v", r.Bands)
+	}
+	for _, band := range r.Bands {
+		if band.Lower == 915000000 {
+			continue
+		}
+		if band.Power > r.Bands[2].Power-20 {
+			t.Errorf("expected band %d to be at least 20 dB below the tone's, got %0.1f and %0.1f", band.Lower, band.Power, r.Bands[2].Power)
+		}
+	}
+
+	if r = sm.Report(); r.Blocks != 0 || r.Bands != nil {
+		t.Errorf("expected report to be reset, got %+v", r)
+	}
+}
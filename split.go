@@ -0,0 +1,142 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2014 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"container/list"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/bemasher/rtlamr/parse"
+)
+
+var formatExt = map[string]string{
+	"plain":    ".txt",
+	"csv":      ".csv",
+	"json":     ".json",
+	"logfmt":   ".log",
+	"xml":      ".xml",
+	"gob":      ".gob",
+	"protobuf": ".pb",
+}
+
+type splitFile struct {
+	meterID   uint32
+	file      *os.File
+	enc       Encoder
+	lastWrite time.Time
+}
+
+// SplitWriter writes each meter's messages to a separate file in a
+// directory. At most maxOpen files are kept open at once, the least recently
+// written file is closed to make room for new ones.
+type SplitWriter struct {
+	dir     string
+	format  string
+	maxOpen int
+
+	files map[uint32]*list.Element
+	lru   *list.List
+}
+
+func NewSplitWriter(dir, format string, maxOpen int) *SplitWriter {
+	return &SplitWriter{
+		dir:     dir,
+		format:  format,
+		maxOpen: maxOpen,
+		files:   make(map[uint32]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// Write appends the message to its meter's file, opening it if necessary.
+func (sw *SplitWriter) Write(msg parse.LogMessage) error {
+	elem, ok := sw.files[msg.MeterID()]
+	if ok {
+		sw.lru.MoveToFront(elem)
+	} else {
+		sf, err := sw.open(msg.MeterID())
+		if err != nil {
+			return err
+		}
+		elem = sw.lru.PushFront(sf)
+		sw.files[sf.meterID] = elem
+	}
+
+	sf := elem.Value.(*splitFile)
+	sf.lastWrite = time.Now()
+
+	return WriteMessage(sf.file, sf.enc, msg)
+}
+
+func (sw *SplitWriter) open(meterID uint32) (sf *splitFile, err error) {
+	// Create the directory lazily on the first message.
+	if len(sw.files) == 0 {
+		err = os.MkdirAll(sw.dir, 0755)
+		if err != nil {
+			return
+		}
+	}
+
+	for sw.lru.Len() >= sw.maxOpen {
+		if err = sw.close(sw.lru.Back()); err != nil {
+			return
+		}
+	}
+
+	filename := filepath.Join(sw.dir, strconv.FormatUint(uint64(meterID), 10)+formatExt[sw.format])
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return
+	}
+
+	sf = &splitFile{meterID: meterID, file: file}
+	sf.enc = NewEncoder(sw.format, file)
+
+	return
+}
+
+func (sw *SplitWriter) close(elem *list.Element) error {
+	sf := sw.lru.Remove(elem).(*splitFile)
+	delete(sw.files, sf.meterID)
+	return sf.file.Close()
+}
+
+// CloseIdle closes files which haven't been written to within idle.
+func (sw *SplitWriter) CloseIdle(idle time.Duration) error {
+	for elem := sw.lru.Back(); elem != nil; elem = sw.lru.Back() {
+		if time.Since(elem.Value.(*splitFile).lastWrite) < idle {
+			break
+		}
+		if err := sw.close(elem); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes all open files.
+func (sw *SplitWriter) Close() (err error) {
+	for sw.lru.Len() > 0 {
+		if cerr := sw.close(sw.lru.Back()); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return
+}
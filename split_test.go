@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/bemasher/rtlamr/parse"
+	"github.com/bemasher/rtlamr/scm"
+)
+
+func TestSplitWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rtlamr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// With one file open at a time, alternating meters closes and reopens
+	// each file on every message.
+	sw := NewSplitWriter(filepath.Join(dir, "meters"), "json", 1)
+	expected := map[uint32][]uint32{}
+	for idx := uint32(0); idx < 6; idx++ {
+		id := 1 + idx%2
+		msg := parse.LogMessage{Message: scm.SCM{ID: id, Type: 7, Consumption: idx}}
+		if err := sw.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+		if sw.lru.Len() != 1 {
+			t.Fatalf("expected 1 open file, got %d", sw.lru.Len())
+		}
+		expected[id] = append(expected[id], idx)
+	}
+	if err := sw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for id, consumption := range expected {
+		f, err := os.Open(filepath.Join(dir, "meters", strconv.FormatUint(uint64(id), 10)+".json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got []uint32
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var rm replayMessage
+			if err := json.Unmarshal(scanner.Bytes(), &rm); err != nil {
+				t.Fatalf("meter %d: %s", id, err)
+			}
+			var msg scm.SCM
+			if err := json.Unmarshal(rm.Message, &msg); err != nil {
+				t.Fatalf("meter %d: %s", id, err)
+			}
+			if msg.ID != id {
+				t.Errorf("meter %d: got a message from meter %d", id, msg.ID)
+			}
+			got = append(got, msg.Consumption)
+		}
+		f.Close()
+
+		if len(got) != len(consumption) {
+			t.Fatalf("meter %d: expected consumption %v, got %v", id, consumption, got)
+		}
+		for idx := range got {
+			if got[idx] != consumption[idx] {
+				t.Errorf("meter %d: expected consumption %v, got %v", id, consumption, got)
+				break
+			}
+		}
+	}
+}